@@ -4,13 +4,22 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
 var (
-	ErrIsDir = errors.New("destination is directory")
+	ErrIsDir         = errors.New("destination is directory")
+	ErrNotDir        = errors.New("destination is not directory")
+	ErrNoSpace       = errors.New("no space left on destination")
+	ErrPathTraversal = errors.New("path escapes from the base directory")
+	ErrNotGzip       = errors.New("file is not gzip format")
+	// ErrCompressionUnsupported is returned if Auth.Compression is set, the ssh
+	// package only supports "none" compression.
+	ErrCompressionUnsupported = errors.New("ssh transport compression is unsupported")
 
 	CopyBufferSize int64 = 1024 * 1024
 	CmdSeperator         = "&&" // or ;
@@ -21,15 +30,79 @@ type Auth struct {
 	Password       string
 	PrivateKey     string
 	PrivateKeyFile string
+	// PrivateKeyBytes is the raw PEM key, it's preferred over PrivateKey if both
+	// are set. It's useful for keys from secret managers.
+	PrivateKeyBytes []byte
+	// ZeroizeAfterUse call WipeSecrets once the ssh config is built.
+	ZeroizeAfterUse bool
 
 	HostKeyCheck ssh.HostKeyCallback
+	// ExpectedHostKeyFingerprint pin the host key by its SHA256 fingerprint as
+	// printed by OpenSSH such as "SHA256:<base64>",
+	// the "SHA256:" prefix is optional. A *HostKeyMismatchError is returned if it
+	// doesn't match, HostKeyCheck is still called if both are set.
+	ExpectedHostKeyFingerprint string
+	// HostKeyAlgorithms is the preferred order of host key algorithms, it's useful
+	// if the pinned host key isn't the first one offered by server.
+	HostKeyAlgorithms []string
+	// BannerCallback receives the login banner sent by server, banner is discarded
+	// if it's nil.
+	BannerCallback func(message string) error
 
+	// TimeoutMs limit both establishing the connection and the ssh handshake,
+	// it's applied per connection so each auth of Mux can have its own timeout.
+	// Zero means no timeout.
 	TimeoutMs  int
 	MaxSession int
+	// LocalAddr is the local source address of connection such as "10.0.0.2" or
+	// "10.0.0.2:0", it must be an address of local interfaces. It's ignored if
+	// connection is dialed through gate.
+	LocalAddr string
+	// NoSFTP skip the sftp setup of connection, only commands can be run.
+	NoSFTP bool
+	// SftpSubsystem is the name of sftp subsystem, default "sftp" is used if empty.
+	SftpSubsystem string
+	// Compression request zlib compression of the ssh transport. The ssh package
+	// only implements "none" for now, so it's rejected with
+	// ErrCompressionUnsupported instead of being ignored silently, use gzip
+	// helpers such as RreadFileGz for text-heavy transfers.
+	Compression bool
+	// RemoteWorkDir and LocalWorkDir override the initial working directories,
+	// which are the sftp login directory and the process working directory by
+	// default. They must be absolute.
+	RemoteWorkDir string
+	LocalWorkDir  string
+	// CommandWrapper wrap all remote commands of the connection, see
+	// SSH.SetCommandWrapper. It can be used to set wrappers per rule for Mux.
+	CommandWrapper func(cmd string) string
 
 	config *ssh.ClientConfig
 }
 
+// HostKeyMismatchError is returned if the fingerprint of host key differs from
+// Auth.ExpectedHostKeyFingerprint.
+type HostKeyMismatchError struct {
+	Host     string
+	Expected string
+	Got      string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("host key mismatch for %s: expect %s, got %s", e.Host, e.Expected, e.Got)
+}
+
+func fingerprintHostKeyCheck(expected string, next ssh.HostKeyCallback) ssh.HostKeyCallback {
+	if !strings.HasPrefix(expected, "SHA256:") {
+		expected = "SHA256:" + expected
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if got := ssh.FingerprintSHA256(key); got != expected {
+			return &HostKeyMismatchError{Host: hostname, Expected: expected, Got: got}
+		}
+		return next(hostname, remote, key)
+	}
+}
+
 func (a *Auth) privateKeyMethod(pemBytes []byte) (ssh.AuthMethod, error) {
 	sign, err := ssh.ParsePrivateKey(pemBytes)
 	if err != nil {
@@ -38,6 +111,61 @@ func (a *Auth) privateKeyMethod(pemBytes []byte) (ssh.AuthMethod, error) {
 	return ssh.PublicKeys(sign), nil
 }
 
+var hostKeyAlgorithms = map[string]bool{
+	ssh.KeyAlgoRSA:            true,
+	ssh.KeyAlgoDSA:            true,
+	ssh.KeyAlgoECDSA256:       true,
+	ssh.KeyAlgoSKECDSA256:     true,
+	ssh.KeyAlgoECDSA384:       true,
+	ssh.KeyAlgoECDSA521:       true,
+	ssh.KeyAlgoED25519:        true,
+	ssh.KeyAlgoSKED25519:      true,
+	ssh.CertAlgoRSAv01:        true,
+	ssh.CertAlgoDSAv01:        true,
+	ssh.CertAlgoECDSA256v01:   true,
+	ssh.CertAlgoSKECDSA256v01: true,
+	ssh.CertAlgoECDSA384v01:   true,
+	ssh.CertAlgoECDSA521v01:   true,
+	ssh.CertAlgoED25519v01:    true,
+	ssh.CertAlgoSKED25519v01:  true,
+}
+
+func (a *Auth) checkHostKeyAlgorithms() error {
+	for _, algo := range a.HostKeyAlgorithms {
+		if !hostKeyAlgorithms[algo] {
+			return fmt.Errorf("unsupported host key algorithm: %s", algo)
+		}
+	}
+	return nil
+}
+
+func (a *Auth) localTCPAddr() (*net.TCPAddr, error) {
+	if a.LocalAddr == "" {
+		return nil, nil
+	}
+	addr := a.LocalAddr
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "0")
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local addr: %s", err.Error())
+	}
+	if tcpAddr.IP == nil || tcpAddr.IP.IsUnspecified() {
+		return tcpAddr, nil
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, ifAddr := range addrs {
+		if ipnet, ok := ifAddr.(*net.IPNet); ok && ipnet.IP.Equal(tcpAddr.IP) {
+			return tcpAddr, nil
+		}
+	}
+	return nil, fmt.Errorf("local addr %s is not an address of local interfaces", a.LocalAddr)
+}
+
 func (a *Auth) MustSSHConfig() *ssh.ClientConfig {
 	cfg, err := a.SSHConfig()
 	if err != nil {
@@ -51,14 +179,22 @@ func (a *Auth) SSHConfig() (*ssh.ClientConfig, error) {
 		return a.config, nil
 	}
 
+	if a.Compression {
+		return nil, ErrCompressionUnsupported
+	}
+
 	config := &ssh.ClientConfig{}
 	config.User = a.User
 	if a.Password != "" {
 		method := ssh.Password(a.Password)
 		config.Auth = append(config.Auth, method)
 	}
-	if len(a.PrivateKey) > 0 {
-		method, err := a.privateKeyMethod([]byte(a.PrivateKey))
+	pemBytes := a.PrivateKeyBytes
+	if len(pemBytes) == 0 && len(a.PrivateKey) > 0 {
+		pemBytes = []byte(a.PrivateKey)
+	}
+	if len(pemBytes) > 0 {
+		method, err := a.privateKeyMethod(pemBytes)
 		if err != nil {
 			return nil, err
 		}
@@ -78,11 +214,97 @@ func (a *Auth) SSHConfig() (*ssh.ClientConfig, error) {
 	if len(config.Auth) == 0 {
 		return nil, errors.New("no auth method supplied")
 	}
+	err := a.checkHostKeyAlgorithms()
+	if err != nil {
+		return nil, err
+	}
+	config.HostKeyAlgorithms = a.HostKeyAlgorithms
+	config.BannerCallback = a.BannerCallback
 	config.Timeout = time.Duration(a.TimeoutMs) * time.Millisecond
 	config.HostKeyCallback = a.HostKeyCheck
 	if config.HostKeyCallback == nil {
 		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
 	}
+	if a.ExpectedHostKeyFingerprint != "" {
+		config.HostKeyCallback = fingerprintHostKeyCheck(a.ExpectedHostKeyFingerprint, config.HostKeyCallback)
+	}
 	a.config = config
+	if a.ZeroizeAfterUse {
+		a.WipeSecrets()
+	}
 	return a.config, nil
 }
+
+// WipeSecrets zero PrivateKeyBytes and clear Password and PrivateKey, the built
+// ssh config is still cached and usable. Strings can't be zeroed in place, only
+// the references to them are dropped.
+func (a *Auth) WipeSecrets() {
+	for i := range a.PrivateKeyBytes {
+		a.PrivateKeyBytes[i] = 0
+	}
+	a.PrivateKeyBytes = nil
+	a.Password = ""
+	a.PrivateKey = ""
+}
+
+// TestConnect dial the host, run a trivial command and close the connection, it
+// returns the auth or transport error if any. It's useful to verify credentials
+// before adding a host to Mux.
+func (a *Auth) TestConnect(addr string, gate ...*SSH) error {
+	s, err := Dial(addr, a, gate...)
+	if err != nil {
+		return err
+	}
+	s.RcmdRaw("true")
+	_, err = s.CloseResult()
+	return err
+}
+
+// authProbeTimeout is the timeout of each connection of ServerAuthMethods
+const authProbeTimeout = 10 * time.Second
+
+var errAuthProbed = errors.New("auth method is probed")
+
+// ServerAuthMethods return the auth methods offered by server for user, such as
+// "publickey", "keyboard-interactive" and "password". ["none"] is returned if the
+// server accepts "none" auth. It's only for diagnostics: host key is not checked,
+// no credential is sent, and each method is probed by a separate connection which
+// is aborted once the server asks for it.
+func ServerAuthMethods(addr, user string) ([]string, error) {
+	var methods []string
+	for _, method := range []string{"publickey", "keyboard-interactive", "password"} {
+		var offered bool
+		probe := func() error {
+			offered = true
+			return errAuthProbed
+		}
+		var am ssh.AuthMethod
+		switch method {
+		case "publickey":
+			am = ssh.PublicKeysCallback(func() ([]ssh.Signer, error) { return nil, probe() })
+		case "keyboard-interactive":
+			am = ssh.KeyboardInteractive(func(string, string, []string, []bool) ([]string, error) { return nil, probe() })
+		case "password":
+			am = ssh.PasswordCallback(func() (string, error) { return "", probe() })
+		}
+		client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{am},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         authProbeTimeout,
+		})
+		if err == nil {
+			client.Close()
+			return []string{"none"}, nil
+		}
+		if offered {
+			methods = append(methods, method)
+			continue
+		}
+		// the auth error of ssh package is not typed
+		if !strings.Contains(err.Error(), "unable to authenticate") {
+			return nil, err
+		}
+	}
+	return methods, nil
+}
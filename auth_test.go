@@ -0,0 +1,161 @@
+package socker
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func testPrivateKey(t *testing.T) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+func TestAuthPrivateKeyBytes(t *testing.T) {
+	a := &Auth{User: "root", PrivateKeyBytes: testPrivateKey(t), PrivateKey: "invalid"}
+	cfg, err := a.SSHConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Auth) != 1 {
+		t.Errorf("expect one auth method, got %d", len(cfg.Auth))
+	}
+
+	a = &Auth{User: "root", PrivateKeyBytes: []byte("invalid")}
+	if _, err = a.SSHConfig(); err == nil {
+		t.Error("invalid private key should be rejected")
+	}
+}
+
+func TestAuthZeroizeAfterUse(t *testing.T) {
+	key := testPrivateKey(t)
+	a := &Auth{User: "root", Password: "root", PrivateKeyBytes: key, ZeroizeAfterUse: true}
+	cfg, err := a.SSHConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Password != "" || a.PrivateKeyBytes != nil {
+		t.Error("secrets should be wiped")
+	}
+	for _, b := range key {
+		if b != 0 {
+			t.Fatal("key bytes should be zeroed")
+		}
+	}
+	if c, err := a.SSHConfig(); err != nil || c != cfg || len(c.Auth) != 2 {
+		t.Errorf("cached config should be kept: %v", err)
+	}
+}
+
+func TestAuthHostKeyAlgorithms(t *testing.T) {
+	a := &Auth{User: "root", Password: "root", HostKeyAlgorithms: []string{ssh.KeyAlgoED25519}}
+	cfg, err := a.SSHConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.HostKeyAlgorithms) != 1 || cfg.HostKeyAlgorithms[0] != ssh.KeyAlgoED25519 {
+		t.Errorf("host key algorithms not applied: %v", cfg.HostKeyAlgorithms)
+	}
+
+	a = &Auth{User: "root", Password: "root", HostKeyAlgorithms: []string{"ssh-unknown"}}
+	if _, err = a.SSHConfig(); err == nil {
+		t.Error("unknown host key algorithm should be rejected")
+	}
+}
+
+func TestAuthLocalAddr(t *testing.T) {
+	type testCase struct {
+		LocalAddr string
+		Valid     bool
+	}
+
+	cases := []testCase{
+		{LocalAddr: "", Valid: true},
+		{LocalAddr: "127.0.0.1", Valid: true},
+		{LocalAddr: "127.0.0.1:0", Valid: true},
+		{LocalAddr: "not an addr", Valid: false},
+		{LocalAddr: "192.0.2.255", Valid: false},
+	}
+	for i, c := range cases {
+		a := &Auth{LocalAddr: c.LocalAddr}
+		if _, err := a.localTCPAddr(); (err == nil) != c.Valid {
+			t.Errorf("test case failed: %d, %v", i, err)
+		}
+	}
+}
+
+func TestServerAuthMethods(t *testing.T) {
+	var execs int32
+	addr, closeFn := serveTestSSH(t, &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+			return nil, errors.New("password should not be sent")
+		},
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, errors.New("public key should not be sent")
+		},
+	}, &execs)
+	defer closeFn()
+
+	methods, err := ServerAuthMethods(addr, "root")
+	if err != nil || strings.Join(methods, ",") != "publickey,password" {
+		t.Errorf("unexpected methods: %v, %v", methods, err)
+	}
+
+	addr, closeFn = serveTestSSH(t, &ssh.ServerConfig{NoClientAuth: true}, &execs)
+	defer closeFn()
+	if methods, err = ServerAuthMethods(addr, "root"); err != nil || len(methods) != 1 || methods[0] != "none" {
+		t.Errorf("expect none auth, got %v, %v", methods, err)
+	}
+}
+
+func TestAuthCompression(t *testing.T) {
+	auth := &Auth{User: "root", Password: "root", Compression: true}
+	if _, err := auth.SSHConfig(); err != ErrCompressionUnsupported {
+		t.Errorf("expect compression unsupported, got %v", err)
+	}
+	_, err := NewMux(MuxAuth{AuthMethods: map[string]*Auth{"root": auth}})
+	if err == nil || !strings.Contains(err.Error(), ErrCompressionUnsupported.Error()) {
+		t.Errorf("mux should reject compression, got %v", err)
+	}
+}
+
+func TestAuthHostKeyFingerprint(t *testing.T) {
+	var execs int32
+	addr, closeFn := newTestSSHServer(t, &execs)
+	defer closeFn()
+
+	// host key of the test server is generated randomly
+	var fingerprint string
+	s, err := Dial(addr, &Auth{User: "root", Password: "root", NoSFTP: true, HostKeyCheck: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+		fingerprint = ssh.FingerprintSHA256(key)
+		return nil
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	for _, expected := range []string{fingerprint, strings.TrimPrefix(fingerprint, "SHA256:")} {
+		s, err := Dial(addr, &Auth{User: "root", Password: "root", NoSFTP: true, ExpectedHostKeyFingerprint: expected})
+		if err != nil {
+			t.Fatalf("matched fingerprint %s should pass: %v", expected, err)
+		}
+		s.Close()
+	}
+
+	_, err = Dial(addr, &Auth{User: "root", Password: "root", NoSFTP: true, ExpectedHostKeyFingerprint: "SHA256:mismatch"})
+	var mismatch *HostKeyMismatchError
+	if !errors.As(err, &mismatch) || mismatch.Got != fingerprint || mismatch.Expected != "SHA256:mismatch" {
+		t.Errorf("expect host key mismatch error, got %v", err)
+	}
+}
@@ -25,10 +25,19 @@ type Filepath interface {
 	IsAbs(path string) bool
 }
 
+// AbsFilepath is implemented by Filepath which can resolve relative paths by
+// the working directory, such as the local one.
+type AbsFilepath interface {
+	Abs(path string) (string, error)
+}
+
 type localFilepath struct {
 }
 
-var _ Filepath = localFilepath{}
+var (
+	_ Filepath    = localFilepath{}
+	_ AbsFilepath = localFilepath{}
+)
 
 func (localFilepath) Separator() uint8                     { return filepath.Separator }
 func (localFilepath) ListSeparator() uint8                 { return filepath.ListSeparator }
@@ -47,6 +56,9 @@ func (localFilepath) Base(path string) string       { return filepath.Base(path)
 func (localFilepath) Dir(path string) string        { return filepath.Dir(path) }
 func (localFilepath) VolumeName(path string) string { return filepath.VolumeName(path) }
 func (localFilepath) IsAbs(path string) bool        { return filepath.IsAbs(path) }
+func (localFilepath) Abs(path string) (string, error) {
+	return filepath.Abs(path)
+}
 
 type virtualFilepath struct {
 	IsUnix            bool
@@ -222,6 +234,24 @@ func (f virtualFilepath) VolumeName(path string) string {
 	return path[:f.volumeNameLen(path)]
 }
 
+var errWdUnavailable = errors.New("working directory unavailable")
+
+var _ AbsFilepath = virtualFilepath{}
+
+func (f virtualFilepath) Abs(path string) (string, error) {
+	if f.IsAbs(path) {
+		return f.Clean(path), nil
+	}
+	if f.Getwd == nil {
+		return "", errWdUnavailable
+	}
+	wd, err := f.Getwd()
+	if err != nil {
+		return "", err
+	}
+	return f.Join(wd, path), nil
+}
+
 func (f virtualFilepath) IsAbs(path string) bool {
 	if f.IsUnix {
 		return f.unixIsAbs(path)
@@ -28,3 +28,18 @@ func TestFilepath(t *testing.T) {
 		t.Error("test volumeName failed")
 	}
 }
+
+func TestFilepathAbsWithoutGetwd(t *testing.T) {
+	var vfpath AbsFilepath = virtualFilepath{
+		PathSeparator:     '/',
+		PathListSeparator: ':',
+		IsUnix:            true,
+	}
+
+	if _, err := vfpath.Abs("rel"); err != errWdUnavailable {
+		t.Errorf("expect working directory unavailable, got %v", err)
+	}
+	if path, err := vfpath.Abs("/a/../b"); err != nil || path != "/b" {
+		t.Errorf("abs of absolute path failed: %s, %v", path, err)
+	}
+}
@@ -38,6 +38,33 @@ type Fs interface {
 	io.Closer
 }
 
+// Statfs is the space usage of a filesystem in bytes
+type Statfs struct {
+	Total uint64
+	Free  uint64
+	// Avail is the free space available to unprivileged users
+	Avail uint64
+}
+
+// StatfsFs is implemented by Fs which can report the space usage, such as
+// FsSftp if the server supports the "statvfs@openssh.com" extension.
+type StatfsFs interface {
+	Statfs(path string) (Statfs, error)
+}
+
+// NoSpaceFs is implemented by Fs which can recognize errors caused by disk full
+// or quota exceeded, they are reported as ErrNoSpace by transfers.
+type NoSpaceFs interface {
+	IsNoSpace(err error) bool
+}
+
+// isNoSpace report whether the error is caused by no space, it's false if fs
+// doesn't implement NoSpaceFs.
+func isNoSpace(fs Fs, err error) bool {
+	nfs, ok := fs.(NoSpaceFs)
+	return ok && nfs.IsNoSpace(err)
+}
+
 // File is the abstract interface for local and sftp file
 type File interface {
 	io.Closer
@@ -0,0 +1,102 @@
+package socker
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+func hasGlobMeta(path string) bool {
+	return strings.ContainsAny(path, `*?[`)
+}
+
+// checkGlobs check the syntax of patterns
+func checkGlobs(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %s: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matchGlobs report whether the slash-separated relative path matches any
+// pattern, patterns without slash match the base name.
+func matchGlobs(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		name := rel
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(rel)
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// fsGlob is the same as filepath.Glob but works for any Fs
+func fsGlob(fs Fs, pattern string) ([]string, error) {
+	// check pattern syntax
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	fpath := fs.Filepath()
+	if !hasGlobMeta(pattern) {
+		if _, err := fs.Lstat(pattern); err != nil {
+			if fs.IsNotExist(err) {
+				err = nil
+			}
+			return nil, err
+		}
+		return []string{pattern}, nil
+	}
+
+	dir, file := fpath.Split(pattern)
+	dir = fpath.Clean(dir)
+	if !hasGlobMeta(dir) {
+		return fsGlobDir(fs, dir, file, nil)
+	}
+
+	dirs, err := fsGlob(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, d := range dirs {
+		matches, err = fsGlobDir(fs, d, file, matches)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return matches, nil
+}
+
+func fsGlobDir(fs Fs, dir, pattern string, matches []string) ([]string, error) {
+	stat, err := fs.Stat(dir)
+	if err != nil || !stat.IsDir() {
+		// ignore I/O error like filepath.Glob
+		return matches, nil
+	}
+	fd, err := fs.Open(dir)
+	if err != nil {
+		return matches, nil
+	}
+	names, _ := fd.Readdirnames(-1)
+	fd.Close()
+	sort.Strings(names)
+
+	fpath := fs.Filepath()
+	for _, name := range names {
+		matched, err := path.Match(pattern, name)
+		if err != nil {
+			return matches, err
+		}
+		if matched {
+			matches = append(matches, fpath.Join(dir, name))
+		}
+	}
+	return matches, nil
+}
@@ -0,0 +1,91 @@
+package socker
+
+import "os"
+
+// FileHooks are callbacks of files opened by InstrumentedFs, name is the name of
+// the file. Nil callbacks are skipped. They may be called concurrently for
+// different files.
+type FileHooks struct {
+	OnRead  func(name string, n int, err error)
+	OnWrite func(name string, n int, err error)
+	OnClose func(name string, err error)
+}
+
+// instrumentedFs wrap all files opened from underlying fs with hooks
+type instrumentedFs struct {
+	Fs
+
+	hooks FileHooks
+}
+
+// InstrumentedFs wrap fs to call hooks on reading, writing and closing of every
+// opened file, such as for transfer accounting or logging. It composes with any
+// Fs, use SSH.SetRemoteFs or SSH.SetLocalFs to apply it.
+func InstrumentedFs(fs Fs, hooks FileHooks) Fs {
+	return instrumentedFs{Fs: fs, hooks: hooks}
+}
+
+func (f instrumentedFs) wrap(fd File, err error) (File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return instrumentedFile{File: fd, hooks: f.hooks}, nil
+}
+
+func (f instrumentedFs) Create(name string) (File, error) {
+	return f.wrap(f.Fs.Create(name))
+}
+
+func (f instrumentedFs) Open(name string) (File, error) {
+	return f.wrap(f.Fs.Open(name))
+}
+
+func (f instrumentedFs) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return f.wrap(f.Fs.OpenFile(name, flag, perm))
+}
+
+func (f instrumentedFs) Statfs(path string) (Statfs, error) {
+	return statfs(f.Fs, path)
+}
+
+func (f instrumentedFs) IsNoSpace(err error) bool {
+	return isNoSpace(f.Fs, err)
+}
+
+type instrumentedFile struct {
+	File
+
+	hooks FileHooks
+}
+
+func (f instrumentedFile) Read(b []byte) (int, error) {
+	n, err := f.File.Read(b)
+	if f.hooks.OnRead != nil {
+		f.hooks.OnRead(f.Name(), n, err)
+	}
+	return n, err
+}
+
+func (f instrumentedFile) Write(b []byte) (int, error) {
+	n, err := f.File.Write(b)
+	if f.hooks.OnWrite != nil {
+		f.hooks.OnWrite(f.Name(), n, err)
+	}
+	return n, err
+}
+
+func (f instrumentedFile) WriteString(s string) (int, error) {
+	n, err := f.File.WriteString(s)
+	if f.hooks.OnWrite != nil {
+		f.hooks.OnWrite(f.Name(), n, err)
+	}
+	return n, err
+}
+
+func (f instrumentedFile) Close() error {
+	err := f.File.Close()
+	if f.hooks.OnClose != nil {
+		f.hooks.OnClose(f.Name(), err)
+	}
+	return err
+}
@@ -0,0 +1,52 @@
+package socker
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestInstrumentedFs(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	var (
+		mu            sync.Mutex
+		read, written int
+		closed        = make(map[string]int)
+	)
+	fs := InstrumentedFs(NewFsMem(), FileHooks{
+		OnRead: func(name string, n int, err error) {
+			mu.Lock()
+			read += n
+			mu.Unlock()
+		},
+		OnWrite: func(name string, n int, err error) {
+			mu.Lock()
+			written += n
+			mu.Unlock()
+		},
+		OnClose: func(name string, err error) {
+			mu.Lock()
+			closed[name]++
+			mu.Unlock()
+		},
+	})
+
+	s := LocalOnly()
+	s.SetRemoteFs(fs)
+	s.Rcd("/remote")
+	s.LwriteFile(filepath.Join(dir, "src"), []byte("socker"))
+	s.Put(filepath.Join(dir, "src"), "dst")
+	s.Get("dst", filepath.Join(dir, "back"))
+	if err := s.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if read != 6 || written != 6 || closed["/remote/dst"] != 2 {
+		t.Errorf("unexpected accounting: read %d, written %d, closed %v", read, written, closed)
+	}
+	if _, err := statfs(fs, "/"); err != ErrStatfsUnsupported {
+		t.Errorf("statfs should be passed through, got %v", err)
+	}
+}
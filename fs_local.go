@@ -1,7 +1,9 @@
 package socker
 
 import (
+	"errors"
 	"os"
+	"syscall"
 	"time"
 )
 
@@ -44,6 +46,10 @@ func (FsLocal) IsPermission(err error) bool {
 	return os.IsPermission(err)
 }
 
+func (FsLocal) IsNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
 func (FsLocal) Mkdir(name string, perm os.FileMode) error {
 	return os.Mkdir(name, perm)
 }
@@ -0,0 +1,570 @@
+package socker
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FsMem is a memory-backed filesystem, it's useful for testing file operations
+// without network. Relative paths are based on the root, symbolic links are only
+// resolved for the last element of path. It's safe for concurrent use.
+type FsMem struct {
+	mu    sync.RWMutex
+	nodes map[string]*memNode
+	fpath Filepath
+}
+
+var _ Fs = (*FsMem)(nil)
+
+type memNode struct {
+	mode  os.FileMode
+	data  []byte
+	link  string
+	atime time.Time
+	mtime time.Time
+}
+
+// NewFsMem create an empty FsMem with unix paths, the root is "/".
+func NewFsMem() *FsMem {
+	return newFsMem(virtualFilepath{
+		PathSeparator:     '/',
+		PathListSeparator: ':',
+		IsUnix:            true,
+		Getwd:             func() (string, error) { return "/", nil },
+	})
+}
+
+// NewFsMemWindows create an empty FsMem with windows paths, volumes such as
+// "C:" are created as directories by MkdirAll.
+func NewFsMemWindows() *FsMem {
+	return newFsMem(virtualFilepath{
+		PathSeparator:     '\\',
+		PathListSeparator: ';',
+		Getwd:             func() (string, error) { return `C:\`, nil },
+	})
+}
+
+func newFsMem(fpath Filepath) *FsMem {
+	now := time.Now()
+	return &FsMem{
+		nodes: map[string]*memNode{
+			"/": {mode: os.ModeDir | 0755, atime: now, mtime: now},
+		},
+		fpath: fpath,
+	}
+}
+
+func (f *FsMem) Filepath() Filepath {
+	return f.fpath
+}
+
+// key return the slash-separated absolute path used as node key
+func (f *FsMem) key(name string) string {
+	return path.Clean("/" + f.fpath.ToSlash(name))
+}
+
+func memErr(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// lookup return the node of path, the symbolic link is resolved if follow is true.
+// It must be called with lock held.
+func (f *FsMem) lookup(op, name string, follow bool) (string, *memNode, error) {
+	p := f.key(name)
+	for i := 0; i < 40; i++ {
+		node, has := f.nodes[p]
+		if !has {
+			return p, nil, memErr(op, name, os.ErrNotExist)
+		}
+		if !follow || node.mode&os.ModeSymlink == 0 {
+			return p, node, nil
+		}
+		if f.fpath.IsAbs(node.link) {
+			p = f.key(node.link)
+		} else {
+			p = path.Join(path.Dir(p), f.fpath.ToSlash(node.link))
+		}
+	}
+	return p, nil, memErr(op, name, errors.New("too many levels of symbolic links"))
+}
+
+// create add a node to path, the parent must be an existing directory. It must
+// be called with lock held.
+func (f *FsMem) create(op, name string, node *memNode) error {
+	p := f.key(name)
+	if _, has := f.nodes[p]; has {
+		return memErr(op, name, os.ErrExist)
+	}
+	parent, has := f.nodes[path.Dir(p)]
+	if !has {
+		return memErr(op, name, os.ErrNotExist)
+	}
+	if !parent.mode.IsDir() {
+		return memErr(op, name, ErrNotDir)
+	}
+	now := time.Now()
+	node.atime, node.mtime = now, now
+	f.nodes[p] = node
+	parent.mtime = now
+	return nil
+}
+
+// children return sorted paths of direct children of dir. It must be called with
+// lock held.
+func (f *FsMem) children(dir string) []string {
+	prefix := dir
+	if prefix != "/" {
+		prefix += "/"
+	}
+	var paths []string
+	for p := range f.nodes {
+		if p != "/" && strings.HasPrefix(p, prefix) && !strings.Contains(p[len(prefix):], "/") {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (f *FsMem) Chmod(name string, mode os.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, node, err := f.lookup("chmod", name, true)
+	if err != nil {
+		return err
+	}
+	node.mode = node.mode&^os.ModePerm | mode&os.ModePerm
+	return nil
+}
+
+// Chown only check the existence of file, owners are not recorded.
+func (f *FsMem) Chown(name string, uid, gid int) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	_, _, err := f.lookup("chown", name, true)
+	return err
+}
+
+func (f *FsMem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, node, err := f.lookup("chtimes", name, true)
+	if err != nil {
+		return err
+	}
+	node.atime, node.mtime = atime, mtime
+	return nil
+}
+
+func (f *FsMem) IsExist(err error) bool {
+	return os.IsExist(err)
+}
+
+func (f *FsMem) IsNotExist(err error) bool {
+	return os.IsNotExist(err)
+}
+
+func (f *FsMem) IsPermission(err error) bool {
+	return os.IsPermission(err)
+}
+
+func (f *FsMem) IsNoSpace(err error) bool {
+	return false
+}
+
+func (f *FsMem) Mkdir(name string, perm os.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.create("mkdir", name, &memNode{mode: os.ModeDir | perm&os.ModePerm})
+}
+
+func (f *FsMem) MkdirAll(name string, perm os.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p := f.key(name)
+	var dirs []string
+	for ; p != "/"; p = path.Dir(p) {
+		dirs = append(dirs, p)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		_, node, err := f.lookup("mkdir", dirs[i], true)
+		if err == nil {
+			if !node.mode.IsDir() {
+				return memErr("mkdir", dirs[i], ErrNotDir)
+			}
+			continue
+		}
+		err = f.create("mkdir", dirs[i], &memNode{mode: os.ModeDir | perm&os.ModePerm})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FsMem) Readlink(name string) (string, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	_, node, err := f.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if node.mode&os.ModeSymlink == 0 {
+		return "", memErr("readlink", name, errors.New("not a symbolic link"))
+	}
+	return node.link, nil
+}
+
+func (f *FsMem) Remove(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, node, err := f.lookup("remove", name, false)
+	if err != nil {
+		return err
+	}
+	if p == "/" || node.mode.IsDir() && len(f.children(p)) > 0 {
+		return memErr("remove", name, errors.New("directory not empty"))
+	}
+	delete(f.nodes, p)
+	return nil
+}
+
+func (f *FsMem) RemoveAll(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := f.key(name)
+	for np := range f.nodes {
+		if np != "/" && (np == p || strings.HasPrefix(np, p+"/") || p == "/") {
+			delete(f.nodes, np)
+		}
+	}
+	return nil
+}
+
+func (f *FsMem) Rename(oldpath, newpath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	op, node, err := f.lookup("rename", oldpath, false)
+	if err != nil {
+		return err
+	}
+	np := f.key(newpath)
+	if op == np {
+		return nil
+	}
+	if op == "/" || strings.HasPrefix(np, op+"/") {
+		return memErr("rename", oldpath, errors.New("invalid argument"))
+	}
+	if dst, has := f.nodes[np]; has {
+		if dst.mode.IsDir() && (!node.mode.IsDir() || len(f.children(np)) > 0) {
+			return memErr("rename", newpath, os.ErrExist)
+		}
+		delete(f.nodes, np)
+	}
+	parent, has := f.nodes[path.Dir(np)]
+	if !has || !parent.mode.IsDir() {
+		return memErr("rename", newpath, os.ErrNotExist)
+	}
+
+	for p, n := range f.nodes {
+		if p == op || strings.HasPrefix(p, op+"/") {
+			delete(f.nodes, p)
+			f.nodes[np+p[len(op):]] = n
+		}
+	}
+	return nil
+}
+
+func (f *FsMem) SameFile(fi1, fi2 os.FileInfo) bool {
+	n1, ok1 := fi1.Sys().(*memNode)
+	n2, ok2 := fi2.Sys().(*memNode)
+	return ok1 && ok2 && n1 == n2
+}
+
+func (f *FsMem) Symlink(oldname, newname string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.create("symlink", newname, &memNode{mode: os.ModeSymlink | 0777, link: oldname})
+}
+
+func (f *FsMem) Truncate(name string, size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, node, err := f.lookup("truncate", name, true)
+	if err != nil {
+		return err
+	}
+	if node.mode.IsDir() {
+		return memErr("truncate", name, ErrIsDir)
+	}
+	node.truncate(size)
+	return nil
+}
+
+func (n *memNode) truncate(size int64) {
+	if size <= int64(len(n.data)) {
+		n.data = n.data[:size]
+	} else {
+		n.data = append(n.data, make([]byte, size-int64(len(n.data)))...)
+	}
+	n.mtime = time.Now()
+}
+
+func (f *FsMem) Create(name string) (File, error) {
+	return f.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (f *FsMem) Open(name string) (File, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (f *FsMem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, node, err := f.lookup("open", name, true)
+	if err != nil {
+		if flag&os.O_CREATE == 0 || !f.IsNotExist(err) {
+			return nil, err
+		}
+		node = &memNode{mode: perm & os.ModePerm}
+		err = f.create("open", p, node)
+		if err != nil {
+			return nil, err
+		}
+	} else if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, memErr("open", name, os.ErrExist)
+	}
+
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if node.mode.IsDir() && writable {
+		return nil, memErr("open", name, ErrIsDir)
+	}
+	if flag&os.O_TRUNC != 0 && writable {
+		node.truncate(0)
+	}
+	return &memFile{fs: f, node: node, name: name, path: p, flag: flag}, nil
+}
+
+func (f *FsMem) Lstat(name string) (os.FileInfo, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	p, node, err := f.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return node.stat(p), nil
+}
+
+func (f *FsMem) Stat(name string) (os.FileInfo, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	p, node, err := f.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return node.stat(p), nil
+}
+
+func (f *FsMem) Close() error {
+	return nil
+}
+
+func (n *memNode) stat(p string) os.FileInfo {
+	return memFileInfo{
+		name:  path.Base(p),
+		size:  int64(len(n.data)),
+		mode:  n.mode,
+		mtime: n.mtime,
+		node:  n,
+	}
+}
+
+type memFileInfo struct {
+	name  string
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+	node  *memNode
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() os.FileMode  { return i.mode }
+func (i memFileInfo) ModTime() time.Time { return i.mtime }
+func (i memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memFileInfo) Sys() interface{}   { return i.node }
+
+type memFile struct {
+	fs     *FsMem
+	node   *memNode
+	name   string
+	path   string
+	flag   int
+	off    int64
+	dirOff int
+	closed bool
+}
+
+var errFileClosed = errors.New("file already closed")
+
+func (f *memFile) check(op string, write bool) error {
+	if f.closed {
+		return memErr(op, f.name, errFileClosed)
+	}
+	writable := f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+	readable := f.flag&os.O_WRONLY == 0
+	if write && !writable || !write && !readable {
+		return memErr(op, f.name, os.ErrPermission)
+	}
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return memErr("close", f.name, errFileClosed)
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Chmod(mode os.FileMode) error {
+	return f.fs.Chmod(f.path, mode)
+}
+
+func (f *memFile) Chown(uid, gid int) error {
+	return f.fs.Chown(f.path, uid, gid)
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Read(b []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if f.node.mode.IsDir() {
+		return 0, memErr("read", f.name, ErrIsDir)
+	}
+	if f.off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.node.data[f.off:])
+	f.off += int64(n)
+	f.node.atime = time.Now()
+	return n, nil
+}
+
+func (f *memFile) Readdir(n int) ([]os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("readdir", false); err != nil {
+		return nil, err
+	}
+	if !f.node.mode.IsDir() {
+		return nil, memErr("readdir", f.name, ErrNotDir)
+	}
+
+	paths := f.fs.children(f.path)
+	if f.dirOff > len(paths) {
+		f.dirOff = len(paths)
+	}
+	paths = paths[f.dirOff:]
+	if n > 0 {
+		if len(paths) == 0 {
+			return nil, io.EOF
+		}
+		if len(paths) > n {
+			paths = paths[:n]
+		}
+	}
+	f.dirOff += len(paths)
+
+	infos := make([]os.FileInfo, 0, len(paths))
+	for _, p := range paths {
+		infos = append(infos, f.fs.nodes[p].stat(p))
+	}
+	return infos, nil
+}
+
+func (f *memFile) Readdirnames(n int) ([]string, error) {
+	infos, err := f.Readdir(n)
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names, err
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, memErr("seek", f.name, errFileClosed)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, memErr("seek", f.name, errors.New("invalid argument"))
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	if f.closed {
+		return nil, memErr("stat", f.name, errFileClosed)
+	}
+	return f.node.stat(f.path), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	f.node.truncate(size)
+	return nil
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.off = int64(len(f.node.data))
+	}
+	end := f.off + int64(len(b))
+	if end > int64(len(f.node.data)) {
+		f.node.truncate(end)
+	}
+	copy(f.node.data[f.off:], b)
+	f.off = end
+	f.node.mtime = time.Now()
+	return len(b), nil
+}
+
+func (f *memFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
@@ -0,0 +1,318 @@
+package socker
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFsMem(t *testing.T) {
+	fs := NewFsMem()
+	if err := fs.MkdirAll("/a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := fs.Create("/a/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteString("hello world")
+	fd.Seek(6, io.SeekStart)
+	fd.WriteString("socker")
+	fd.Close()
+
+	fd, err = fs.Open("/a/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(fd)
+	fd.Close()
+	if err != nil || string(data) != "hello socker" {
+		t.Errorf("read failed: %s, %v", data, err)
+	}
+
+	if err = fs.Mkdir("/a", 0755); !fs.IsExist(err) {
+		t.Errorf("expect exist error, got %v", err)
+	}
+	if err = fs.Remove("/a"); err == nil {
+		t.Error("non-empty directory should not be removed")
+	}
+	if err = fs.Rename("/a", "/c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Stat("/a/b/file"); !fs.IsNotExist(err) {
+		t.Errorf("expect not exist error, got %v", err)
+	}
+	if stat, err := fs.Stat("/c/b/file"); err != nil || stat.Size() != 12 {
+		t.Errorf("rename failed: %v", err)
+	}
+
+	fs.Symlink("b/file", "/c/link")
+	if stat, err := fs.Stat("/c/link"); err != nil || stat.Size() != 12 {
+		t.Errorf("symbolic link is not followed: %v", err)
+	}
+	if stat, err := fs.Lstat("/c/link"); err != nil || stat.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("symbolic link should not be followed: %v", err)
+	}
+
+	fs.RemoveAll("/c")
+	if _, err = fs.Stat("/c/b"); !fs.IsNotExist(err) {
+		t.Errorf("expect not exist error, got %v", err)
+	}
+}
+
+func TestPutGetFsMem(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	os.MkdirAll(filepath.Join(src, "sub", "empty"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "a"), []byte("aaa"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "sub", "b"), []byte("bbb"), 0600)
+
+	s := LocalOnly()
+	s.SetRemoteFs(NewFsMem())
+	s.Rcd("/remote")
+	s.Put(src, "tree")
+	if data := s.RreadFile("tree/sub/b"); string(data) != "bbb" {
+		t.Errorf("put failed: %s, %v", data, s.Error())
+	}
+	if items := s.Rreaddir("tree", -1); len(items) != 2 || items[0].Name() != "a" || !items[1].IsDir() {
+		t.Errorf("unexpected entries: %v", items)
+	}
+
+	s.Get("tree", dst)
+	if err := s.Error(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := s.Diff(dst, "tree")
+	if err != nil || len(entries) != 0 {
+		t.Errorf("trees should be same: %v, %v", entries, err)
+	}
+	if stat, err := os.Stat(filepath.Join(dst, "sub", "empty")); err != nil || !stat.IsDir() {
+		t.Errorf("empty directory should be synced: %v", err)
+	}
+}
+
+func TestFsMemWindows(t *testing.T) {
+	fs := NewFsMemWindows()
+	if err := fs.MkdirAll(`C:\Users\socker`, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := fs.Create(`C:\Users\socker\file.txt`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteString("socker")
+	fd.Truncate(3)
+	fd.Close()
+
+	stat, err := fs.Stat(`C:\Users\socker\file.txt`)
+	if err != nil || stat.Size() != 3 || stat.Name() != "file.txt" {
+		t.Errorf("stat failed: %v", err)
+	}
+	fd, err = fs.Open(`C:\Users`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := fd.Readdirnames(-1)
+	fd.Close()
+	if err != nil || len(names) != 1 || names[0] != "socker" {
+		t.Errorf("readdir failed: %v, %v", names, err)
+	}
+	if !fs.Filepath().IsAbs(`C:\Users`) || fs.Filepath().Separator() != '\\' {
+		t.Error("windows filepath expected")
+	}
+}
+
+func TestFsMemConcurrent(t *testing.T) {
+	fs := NewFsMem()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dir := "/dir/" + strconv.Itoa(i%3)
+			if err := fs.MkdirAll(dir, 0755); err != nil {
+				t.Error(err)
+				return
+			}
+			fd, err := fs.Create(dir + "/" + strconv.Itoa(i))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			fd.WriteString("socker")
+			fd.Close()
+		}(i)
+	}
+	wg.Wait()
+
+	count := 0
+	err := Walk(fs, "/dir", func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			count++
+		}
+		return err
+	})
+	if err != nil || count != 10 {
+		t.Errorf("expect 10 files, got %d, %v", count, err)
+	}
+}
+
+func TestEvalSymlinks(t *testing.T) {
+	fs := NewFsMem()
+	fs.MkdirAll("/srv/releases/5/bin", 0755)
+	fs.Mkdir("/srv/releases/x", 0755)
+	fs.Symlink("releases/5", "/srv/current")
+	fs.Symlink("/srv/current/bin", "/bin")
+	fs.Symlink("..", "/srv/releases/5/up")
+	fs.Symlink("loop", "/loop")
+
+	cases := map[string]string{
+		"/srv/current":        "/srv/releases/5",
+		"/srv/current/../x/.": "/srv/releases/x",
+		"/bin":                "/srv/releases/5/bin",
+		"/srv/current/up/5":   "/srv/releases/5",
+	}
+	for path, expect := range cases {
+		if got, err := EvalSymlinks(fs, path); err != nil || got != expect {
+			t.Errorf("%s: expect %s, got %s, %v", path, expect, got, err)
+		}
+	}
+	if _, err := EvalSymlinks(fs, "/loop"); err == nil {
+		t.Error("symbolic link loop should fail")
+	}
+	if _, err := EvalSymlinks(fs, "/srv/missing"); !fs.IsNotExist(err) {
+		t.Errorf("expect not exist error, got %v", err)
+	}
+}
+
+func TestResolveCwd(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+	os.MkdirAll(filepath.Join(dir, "releases", "5"), 0755)
+	os.Symlink(filepath.Join("releases", "5"), filepath.Join(dir, "current"))
+
+	fs := NewFsMem()
+	fs.MkdirAll("/app/releases/5", 0755)
+	fs.Symlink("releases/5", "/app/current")
+
+	s := LocalOnly()
+	s.SetRemoteFs(fs)
+	s.Rcd("/app/current")
+	s.Lcd(filepath.Join(dir, "current"))
+	if err := s.ResolveCwd(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Rcwd() != "/app/releases/5" || s.Lcwd() != filepath.Join(dir, "releases", "5") {
+		t.Errorf("unexpected working directories: %s, %s", s.Rcwd(), s.Lcwd())
+	}
+
+	s.Rcd("/app/missing")
+	if err := s.ResolveCwd(); err == nil || s.Rcwd() != "/app/missing" {
+		t.Errorf("working directory should be unchanged on error: %s, %v", s.Rcwd(), err)
+	}
+}
+
+func TestSyncFilter(t *testing.T) {
+	filter := &SyncFilter{Include: []string{"*.go", "docs/*"}, Exclude: []string{"vendor", "*_test.go"}}
+	fs := NewFsMem()
+	for _, name := range []string{"/src/main.go", "/src/main_test.go", "/src/README", "/src/vendor/lib.go", "/src/docs/README", "/src/pkg/util.go"} {
+		fs.MkdirAll(path.Dir(name), 0755)
+		fd, _ := fs.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0644)
+		fd.Close()
+	}
+
+	var walked []string
+	err := WalkFilter(fs, "/src", filter, func(path string, info os.FileInfo, err error) error {
+		if !info.IsDir() {
+			walked = append(walked, path)
+		}
+		return err
+	})
+	expect := "/src/docs/README,/src/main.go,/src/pkg/util.go"
+	if got := strings.Join(walked, ","); err != nil || got != expect {
+		t.Errorf("expect %s, got %s, %v", expect, got, err)
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s := LocalOnly()
+	s.SetRemoteFs(fs)
+	s.GetFilter("/src", dir, filter)
+	if err := s.Error(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := s.DiffFilter(dir, "/src", filter)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("filtered trees should be same: %v, %v", entries, err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "vendor")); !os.IsNotExist(err) {
+		t.Errorf("excluded directory should be pruned: %v", err)
+	}
+	if entries, _ = s.Diff(dir, "/src"); len(entries) != 4 {
+		t.Errorf("expect 4 entries only on remote, got %v", entries)
+	}
+
+	if err = WalkFilter(fs, "/src", &SyncFilter{Include: []string{"["}}, nil); err == nil {
+		t.Error("invalid pattern should be rejected")
+	}
+}
+
+func TestWalkProgress(t *testing.T) {
+	fs := NewFsMem()
+	fs.MkdirAll("/tree", 0755)
+	for i := 0; i < 249; i++ {
+		fd, _ := fs.Create("/tree/" + strconv.Itoa(i))
+		fd.Close()
+	}
+
+	var (
+		reports []int
+		walked  int
+	)
+	err := WalkProgress(fs, "/tree", func(count int) {
+		reports = append(reports, count)
+	}, func(path string, info os.FileInfo, err error) error {
+		walked++
+		return err
+	})
+	if err != nil || walked != 250 || len(reports) != 3 || reports[0] != 100 || reports[2] != 250 {
+		t.Errorf("unexpected progress: %v, %d, %v", reports, walked, err)
+	}
+	if err = WalkProgress(fs, "/tree", nil, func(string, os.FileInfo, error) error { return nil }); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFsMemCloseConcurrentRead(t *testing.T) {
+	fs := NewFsMem()
+	fd, err := fs.Create("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteString("socker")
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 1)
+		for {
+			if _, err := fd.Read(buf); err != nil && err != io.EOF {
+				return
+			}
+		}
+	}()
+	if err = fd.Close(); err != nil {
+		t.Error(err)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,124 @@
+package socker
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// retryFs retry idempotent operations of underlying fs on transient errors,
+// logical errors such as not exist are returned immediately.
+type retryFs struct {
+	Fs
+
+	attempts int
+	backoff  time.Duration
+}
+
+func newRetryFs(fs Fs, attempts int, backoff time.Duration) Fs {
+	if rfs, ok := fs.(retryFs); ok {
+		fs = rfs.Fs
+	}
+	if attempts <= 1 {
+		return fs
+	}
+	return retryFs{Fs: fs, attempts: attempts, backoff: backoff}
+}
+
+// sftp status codes of connection failures
+const (
+	sftpNoConnection   = 6
+	sftpConnectionLost = 7
+)
+
+// isTransient report whether the error is a transient failure reported by the
+// server, only these errors are retried. Transport errors such as EOF mean the
+// sftp client is broken and every retry would fail the same, logical errors
+// such as not exist, is a directory, generic sftp failure and ErrConnClosed are
+// not retried either.
+func (f retryFs) isTransient(err error) bool {
+	var status *sftp.StatusError
+	if errors.As(err, &status) {
+		return status.Code == sftpNoConnection || status.Code == sftpConnectionLost
+	}
+	return false
+}
+
+func (f retryFs) retry(fn func() error) error {
+	var err error
+	for i := 0; i < f.attempts; i++ {
+		if i > 0 && f.backoff > 0 {
+			time.Sleep(f.backoff)
+		}
+		err = fn()
+		if err == nil || !f.isTransient(err) {
+			break
+		}
+	}
+	return err
+}
+
+func (f retryFs) Statfs(path string) (Statfs, error) {
+	var st Statfs
+	err := f.retry(func() error {
+		var err error
+		st, err = statfs(f.Fs, path)
+		return err
+	})
+	return st, err
+}
+
+func (f retryFs) IsNoSpace(err error) bool {
+	return isNoSpace(f.Fs, err)
+}
+
+func (f retryFs) Mkdir(name string, perm os.FileMode) error {
+	return f.retry(func() error {
+		return f.Fs.Mkdir(name, perm)
+	})
+}
+
+func (f retryFs) Open(name string) (File, error) {
+	var fd File
+	err := f.retry(func() error {
+		var err error
+		fd, err = f.Fs.Open(name)
+		return err
+	})
+	return fd, err
+}
+
+func (f retryFs) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return f.Fs.OpenFile(name, flag, perm)
+	}
+	var fd File
+	err := f.retry(func() error {
+		var err error
+		fd, err = f.Fs.OpenFile(name, flag, perm)
+		return err
+	})
+	return fd, err
+}
+
+func (f retryFs) Lstat(name string) (os.FileInfo, error) {
+	var fi os.FileInfo
+	err := f.retry(func() error {
+		var err error
+		fi, err = f.Fs.Lstat(name)
+		return err
+	})
+	return fi, err
+}
+
+func (f retryFs) Stat(name string) (os.FileInfo, error) {
+	var fi os.FileInfo
+	err := f.retry(func() error {
+		var err error
+		fi, err = f.Fs.Stat(name)
+		return err
+	})
+	return fi, err
+}
@@ -0,0 +1,139 @@
+package socker
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// flakyLister fails Filelist requests such as stat with the queued errors
+type flakyLister struct {
+	sftp.FileLister
+
+	mu    sync.Mutex
+	errs  []error
+	calls int
+}
+
+func (l *flakyLister) fail(errs ...error) {
+	l.mu.Lock()
+	l.errs, l.calls = errs, 0
+	l.mu.Unlock()
+}
+
+func (l *flakyLister) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	l.mu.Lock()
+	l.calls++
+	var err error
+	if len(l.errs) > 0 {
+		err, l.errs = l.errs[0], l.errs[1:]
+	}
+	l.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return l.FileLister.Filelist(r)
+}
+
+func (l *flakyLister) callCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.calls
+}
+
+// newFlakyFsSftp create a FsSftp connected to an in-memory sftp server whose
+// stat requests can be failed by the lister.
+func newFlakyFsSftp(t *testing.T) (Fs, *flakyLister) {
+	handlers := sftp.InMemHandler()
+	lister := &flakyLister{FileLister: handlers.FileList}
+	handlers.FileList = lister
+
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	server := sftp.NewRequestServer(pipeConn{Reader: sr, WriteCloser: sw}, handlers)
+	go func() {
+		server.Serve()
+		sw.Close()
+	}()
+
+	client, err := sftp.NewClientPipe(cr, cw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewFsSftp(client), lister
+}
+
+func TestRetryFs(t *testing.T) {
+	sfs, lister := newFlakyFsSftp(t)
+	defer sfs.Close()
+	if err := sfs.Mkdir("/data", 0755); err != nil {
+		t.Fatal(err)
+	}
+	fs := newRetryFs(sfs, 3, 0)
+
+	lister.fail(sftp.ErrSSHFxConnectionLost, sftp.ErrSSHFxConnectionLost)
+	if _, err := fs.Stat("/data"); err != nil || lister.callCount() != 3 {
+		t.Errorf("transient error should be retried: %v, %d calls", err, lister.callCount())
+	}
+
+	lister.fail(sftp.ErrSSHFxConnectionLost, sftp.ErrSSHFxConnectionLost, sftp.ErrSSHFxConnectionLost)
+	if _, err := fs.Stat("/data"); err == nil || lister.callCount() != 3 {
+		t.Errorf("retry should stop after attempts: %v, %d calls", err, lister.callCount())
+	}
+
+	lister.fail(errors.New("is a directory"))
+	if _, err := fs.Stat("/data"); err == nil || lister.callCount() != 1 {
+		t.Errorf("generic failure should not be retried: %v, %d calls", err, lister.callCount())
+	}
+
+	lister.fail()
+	if _, err := fs.Stat("/not/exist"); !os.IsNotExist(err) || lister.callCount() != 1 {
+		t.Errorf("logical error should not be retried: %v, %d calls", err, lister.callCount())
+	}
+
+	var calls int
+	err := fs.(retryFs).retry(func() error {
+		calls++
+		return ErrConnClosed
+	})
+	if err != ErrConnClosed || calls != 1 {
+		t.Errorf("closed connection should not be retried: %v, %d calls", err, calls)
+	}
+}
+
+// statCountFs count the Stat calls of underlying fs
+type statCountFs struct {
+	Fs
+	calls int
+}
+
+func (f *statCountFs) Stat(name string) (os.FileInfo, error) {
+	f.calls++
+	return f.Fs.Stat(name)
+}
+
+func TestRetryFsBrokenClient(t *testing.T) {
+	var execs int32
+	addr, closeFn := newTestSSHServer(t, &execs)
+	defer closeFn()
+
+	s, err := Dial(addr, &Auth{User: "root", Password: "root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	sfs := &statCountFs{Fs: s.rfs}
+	s.SetRemoteFs(sfs)
+	s.SetFsRetry(3, 0)
+
+	// the sftp client is broken along with the connection
+	s.conn.client.Close()
+	s.conn.sftp.Wait()
+	if _, err = s.rfs.Stat("/"); err == nil || sfs.calls != 1 {
+		t.Errorf("broken client should not be retried: %v, %d calls", err, sfs.calls)
+	}
+}
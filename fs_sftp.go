@@ -1,6 +1,7 @@
 package socker
 
 import (
+	"errors"
 	"io"
 	"os"
 	"strings"
@@ -11,12 +12,23 @@ import (
 )
 
 type FsSftp struct {
-	sftp  *sftp.Client
-	fpath Filepath
+	sftp *sftp.Client
+	// conn is set if the fs is created by SSH, the sftp client of it is used
+	// instead so that Reconnect is followed.
+	conn    *sshConn
+	fpath   Filepath
+	windows bool
 }
 
 func NewFsSftp(sftp *sftp.Client) Fs {
-	fs := FsSftp{sftp: sftp}
+	return newFsSftp(FsSftp{sftp: sftp})
+}
+
+func newConnFsSftp(conn *sshConn) Fs {
+	return newFsSftp(FsSftp{conn: conn})
+}
+
+func newFsSftp(fs FsSftp) Fs {
 	_, err := fs.Stat("/")
 
 	var (
@@ -32,6 +44,7 @@ func NewFsSftp(sftp *sftp.Client) Fs {
 		separator = '/'
 		listSeparator = ':'
 	}
+	fs.windows = separator == '\\'
 	if separator == os.PathSeparator {
 		fs.fpath = localFilepath{}
 	} else {
@@ -39,30 +52,49 @@ func NewFsSftp(sftp *sftp.Client) Fs {
 			PathSeparator:     separator,
 			PathListSeparator: listSeparator,
 			IsUnix:            separator == '/',
-			Getwd:             sftp.Getwd,
+			Getwd:             fs.Getwd,
 		}
 	}
 	return fs
 }
 
+func (s FsSftp) client() *sftp.Client {
+	if s.conn != nil {
+		return s.conn.sftp
+	}
+	return s.sftp
+}
+
 func (s FsSftp) Filepath() Filepath {
 	return s.fpath
 }
 
+// Chmod change the mode of file. POSIX modes don't apply to Windows remotes, only
+// the owner write bit is respected there to toggle the read-only attribute.
 func (s FsSftp) Chmod(name string, mode os.FileMode) error {
-	return s.sftp.Chmod(name, mode)
+	return s.client().Chmod(name, s.mode(mode))
+}
+
+func (s FsSftp) mode(mode os.FileMode) os.FileMode {
+	if !s.windows {
+		return mode
+	}
+	if mode&0200 == 0 {
+		return mode&^os.ModePerm | 0444
+	}
+	return mode&^os.ModePerm | 0666
 }
 
 func (s FsSftp) Chown(name string, uid, gid int) error {
-	return s.sftp.Chown(name, uid, gid)
+	return s.client().Chown(name, uid, gid)
 }
 
 func (s FsSftp) Chtimes(name string, atime time.Time, mtime time.Time) error {
-	return s.sftp.Chtimes(name, atime, mtime)
+	return s.client().Chtimes(name, atime, mtime)
 }
 
 func (s FsSftp) Getwd() (dir string, err error) {
-	return s.sftp.Getwd()
+	return s.client().Getwd()
 }
 
 func (s FsSftp) IsExist(err error) bool {
@@ -87,17 +119,34 @@ func (s FsSftp) IsPermission(err error) bool {
 	return os.IsPermission(err)
 }
 
+// IsNoSpace report whether the error is caused by disk full or quota exceeded,
+// it's detected by the status codes of sftp v5 and above, or ENOSPC.
+func (s FsSftp) IsNoSpace(err error) bool {
+	const (
+		ssh_FX_NO_SPACE_ON_FILESYSTEM = 14
+		ssh_FX_QUOTA_EXCEEDED         = 15
+	)
+	if err == nil {
+		return false
+	}
+	var se *sftp.StatusError
+	if errors.As(err, &se) && (se.Code == ssh_FX_NO_SPACE_ON_FILESYSTEM || se.Code == ssh_FX_QUOTA_EXCEEDED) {
+		return true
+	}
+	return errors.Is(err, syscall.ENOSPC)
+}
+
 func (s FsSftp) Mkdir(name string, perm os.FileMode) error {
-	err := s.sftp.Mkdir(name)
+	err := s.client().Mkdir(name)
 	if err == nil {
-		err = s.sftp.Chmod(name, perm)
+		err = s.Chmod(name, perm)
 	}
 	return err
 }
 
 func (s FsSftp) MkdirAll(path string, perm os.FileMode) error {
 	// Copy from os.MkdirAll
-	dir, err := s.sftp.Stat(path)
+	dir, err := s.client().Stat(path)
 	if err == nil {
 		if dir.IsDir() {
 			return nil
@@ -131,11 +180,11 @@ func (s FsSftp) MkdirAll(path string, perm os.FileMode) error {
 }
 
 func (s FsSftp) Readlink(name string) (string, error) {
-	return s.sftp.ReadLink(name)
+	return s.client().ReadLink(name)
 }
 
 func (s FsSftp) Remove(name string) error {
-	return s.sftp.Remove(name)
+	return s.client().Remove(name)
 }
 
 func (s FsSftp) removeDir(path string) error {
@@ -201,7 +250,7 @@ func (s FsSftp) RemoveAll(path string) error {
 }
 
 func (s FsSftp) Rename(oldpath, newpath string) error {
-	return s.sftp.Rename(oldpath, newpath)
+	return s.client().Rename(oldpath, newpath)
 }
 
 func (s FsSftp) SameFile(fi1, fi2 os.FileInfo) bool {
@@ -209,11 +258,19 @@ func (s FsSftp) SameFile(fi1, fi2 os.FileInfo) bool {
 }
 
 func (s FsSftp) Symlink(oldname, newname string) error {
-	return s.sftp.Symlink(oldname, newname)
+	return s.client().Symlink(oldname, newname)
 }
 
 func (s FsSftp) Truncate(name string, size int64) error {
-	return s.sftp.Truncate(name, size)
+	return s.client().Truncate(name, size)
+}
+
+func (s FsSftp) Statfs(path string) (Statfs, error) {
+	st, err := s.client().StatVFS(path)
+	if err != nil {
+		return Statfs{}, err
+	}
+	return Statfs{Total: st.TotalSpace(), Free: st.FreeSpace(), Avail: st.Frsize * st.Bavail}, nil
 }
 
 func (s FsSftp) Create(name string) (File, error) {
@@ -221,35 +278,73 @@ func (s FsSftp) Create(name string) (File, error) {
 }
 
 func (s FsSftp) Open(name string) (File, error) {
-	fd, err := s.sftp.Open(name)
+	fd, err := s.client().Open(name)
 
 	return s.newFile(name, fd, err)
 }
 
+// openFileAttempts limit retries of OpenFile when the file is created or
+// removed concurrently between checking and opening.
+const openFileAttempts = 3
+
+// OpenFile open the file with flag, perm is applied regardless of the umask of
+// server if the file is newly created, existing files keep their modes. The
+// file is created exclusively after checking it doesn't exist, so only one of
+// concurrent creators applies perm.
 func (s FsSftp) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
-	var chmod bool
-	if flag&os.O_CREATE != 0 {
-		_, err := s.Stat(name)
-		chmod = err != nil && s.IsNotExist(err)
+	if flag&os.O_CREATE == 0 {
+		fd, err := s.client().OpenFile(name, flag)
+		return s.newFile(name, fd, err)
 	}
+	if flag&os.O_EXCL != 0 {
+		return s.createFile(name, flag, perm)
+	}
+
+	var err error
+	for i := 0; i < openFileAttempts; i++ {
+		_, err = s.client().Stat(name)
+		if err == nil {
+			var fd *sftp.File
+			fd, err = s.client().OpenFile(name, flag&^os.O_CREATE)
+			if err == nil || !s.IsNotExist(err) {
+				return s.newFile(name, fd, err)
+			}
+			// removed after checking
+			continue
+		}
+		if !s.IsNotExist(err) {
+			return nil, err
+		}
+
+		var fd File
+		fd, err = s.createFile(name, flag|os.O_EXCL, perm)
+		if err == nil {
+			return fd, nil
+		}
+		// maybe created after checking
+	}
+	return nil, err
+}
 
-	fd, err := s.sftp.OpenFile(name, flag)
+func (s FsSftp) createFile(name string, flag int, perm os.FileMode) (File, error) {
+	fd, err := s.client().OpenFile(name, flag)
 	if err != nil {
 		return nil, err
 	}
-
-	if chmod {
-		fd.Chmod(perm)
+	err = fd.Chmod(s.mode(perm))
+	if err != nil {
+		fd.Close()
+		return nil, err
 	}
 	return s.newFile(name, fd, nil)
 }
 
 func (s FsSftp) Lstat(name string) (os.FileInfo, error) {
-	return s.sftp.Lstat(name)
+	return s.client().Lstat(name)
 }
 
 func (s FsSftp) Stat(name string) (os.FileInfo, error) {
-	return s.sftp.Stat(name)
+	return s.client().Stat(name)
 }
 
 func (s FsSftp) newFile(path string, fd *sftp.File, err error) (File, error) {
@@ -264,23 +359,42 @@ func (s FsSftp) newFile(path string, fd *sftp.File, err error) (File, error) {
 }
 
 func (s FsSftp) Close() error {
-	return s.sftp.Close()
+	return s.client().Close()
 }
 
 type fileSftp struct {
 	*sftp.File
 	path string
 	sftp FsSftp
+
+	// sftp client doesn't support reading directory partially, entries are read
+	// at first call of Readdir and returned page by page.
+	dirRead bool
+	entries []os.FileInfo
 }
 
 func (f *fileSftp) Readdir(n int) ([]os.FileInfo, error) {
-	fis, err := f.sftp.sftp.ReadDir(f.path)
-	if err != nil {
-		return nil, err
+	if !f.dirRead {
+		fis, err := f.sftp.client().ReadDir(f.path)
+		if err != nil {
+			return nil, err
+		}
+		f.dirRead = true
+		f.entries = fis
+	}
+	if n <= 0 {
+		fis := f.entries
+		f.entries = nil
+		return fis, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
 	}
-	if n > 0 && len(fis) > n {
-		fis = fis[:n]
+	if n > len(f.entries) {
+		n = len(f.entries)
 	}
+	fis := f.entries[:n]
+	f.entries = f.entries[n:]
 	return fis, nil
 }
 
@@ -0,0 +1,296 @@
+package socker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+type pipeConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// newTestFsSftp create a FsSftp connected to an in-process sftp server
+// serving local filesystem.
+func newTestFsSftp(t *testing.T) Fs {
+	return NewFsSftp(newTestSftpClient(t))
+}
+
+func newTestSftpClient(t *testing.T) *sftp.Client {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	server, err := sftp.NewServer(pipeConn{Reader: sr, WriteCloser: sw})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		server.Serve()
+		sw.Close()
+	}()
+
+	client, err := sftp.NewClientPipe(cr, cw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestFsSftpOpenFileConcurrentCreate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	fs := newTestFsSftp(t)
+	defer fs.Close()
+
+	path := filepath.Join(dir, "script.sh")
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			fd, err := fs.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0755)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			fd.Close()
+		}()
+	}
+	wg.Wait()
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode().Perm() != 0755 {
+		t.Errorf("expect mode 0755, got %o", stat.Mode().Perm())
+	}
+}
+
+func TestFsSftpOpenFileKeepMode(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	fs := newTestFsSftp(t)
+	defer fs.Close()
+
+	path := filepath.Join(dir, "id_rsa")
+	if err := ioutil.WriteFile(path, []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(path, 0600)
+	fd, err := fs.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.Close()
+
+	stat, err := os.Stat(path)
+	if err != nil || stat.Mode().Perm() != 0600 || stat.Size() != 0 {
+		t.Errorf("existing file should keep mode 0600 and be truncated: %v, %v", stat, err)
+	}
+	if _, err = fs.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644); err == nil {
+		t.Error("exclusive creating of existing file should fail")
+	}
+}
+
+func TestRchtimesFromSftp(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	fs := newTestFsSftp(t)
+	defer fs.Close()
+
+	ref, path := filepath.Join(dir, "ref"), filepath.Join(dir, "file")
+	ioutil.WriteFile(ref, nil, 0644)
+	ioutil.WriteFile(path, nil, 0644)
+	mtime := time.Unix(1600000000, 0)
+	os.Chtimes(ref, time.Unix(1500000000, 0), mtime)
+
+	s := LocalOnly()
+	s.rfs = fs
+	s.RchtimesFrom(path, ref)
+	if err := s.Error(); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := fs.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the test server reports modify time as access time
+	if !stat.ModTime().Equal(mtime) || !fileAtime(stat).Equal(mtime) {
+		t.Errorf("times are not applied: %s, %s", fileAtime(stat), stat.ModTime())
+	}
+}
+
+func TestWorkDirOverride(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := newSSH(nil, newTestSftpClient(t), 0, nil, "/srv/app", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	wd, _ := os.Getwd()
+	if s.Rcwd() != "/srv/app" || s.Lcwd() != dir || s.rhome != wd {
+		t.Errorf("unexpected directories: %s, %s, %s", s.Rcwd(), s.Lcwd(), s.rhome)
+	}
+
+	if _, err = newSSH(nil, newTestSftpClient(t), 0, nil, "srv/app", ""); err == nil {
+		t.Error("relative remote work dir should be rejected")
+	}
+	if _, err = newSSH(nil, nil, 0, nil, "", "tmp"); err == nil {
+		t.Error("relative local work dir should be rejected")
+	}
+	if s, err = newSSH(nil, nil, 0, nil, "/srv/app", ""); err != nil || s.Rcwd() != "/srv/app" {
+		t.Errorf("remote work dir should be used without sftp: %v", err)
+	}
+}
+
+// serveEmptyWdSftp serve a minimal sftp server whose realpath always return
+// empty path and other requests fail.
+func serveEmptyWdSftp(r io.Reader, w io.WriteCloser) {
+	defer w.Close()
+	reply := func(typ byte, data []byte) {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, uint32(len(data)+1))
+		buf.WriteByte(typ)
+		buf.Write(data)
+		w.Write(buf.Bytes())
+	}
+	for {
+		var length uint32
+		if binary.Read(r, binary.BigEndian, &length) != nil {
+			return
+		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(r, packet); err != nil {
+			return
+		}
+		const (
+			fxpInit     = 1
+			fxpVersion  = 2
+			fxpStatus   = 101
+			fxpRealpath = 16
+			fxpName     = 104
+		)
+		switch packet[0] {
+		case fxpInit:
+			reply(fxpVersion, []byte{0, 0, 0, 3})
+		case fxpRealpath:
+			// id, count 1, empty filename, empty longname, no attrs
+			reply(fxpName, append(packet[1:5], 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0))
+		default:
+			// id, SSH_FX_FAILURE, empty message and language tag
+			reply(fxpStatus, append(packet[1:5], 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0))
+		}
+	}
+}
+
+func TestEmptyRemoteWorkDir(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	go serveEmptyWdSftp(sr, sw)
+	client, err := sftp.NewClientPipe(cr, cw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wd, err := client.Getwd(); err != nil || wd != "" {
+		t.Fatalf("fake server should return empty path: %q, %v", wd, err)
+	}
+
+	s, err := newSSH(nil, client, 0, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Rcwd() != "/" || s.rhome != "/" {
+		t.Errorf("empty remote work dir should be treated as root: %q, %q", s.Rcwd(), s.rhome)
+	}
+}
+
+func TestPutCheckSpace(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := newSSH(nil, newTestSftpClient(t), 0, nil, dir, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	st, err := s.Rstatfs(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Total == 0 || st.Avail > st.Total || st.Free > st.Total {
+		t.Errorf("unexpected space usage: %+v", st)
+	}
+	s.SetFsRetry(3, 0)
+	if _, err = s.Rstatfs("."); err != nil {
+		t.Errorf("statfs should work with retrying fs: %v", err)
+	}
+
+	s.LwriteFile("small", []byte("socker"))
+	s.PutCheckSpace("small", "a/b/small")
+	if data := s.RreadFile("a/b/small"); s.Error() != nil || string(data) != "socker" {
+		t.Fatalf("put failed: %s, %v", data, s.Error())
+	}
+
+	// sparse file takes no space locally
+	fd, err := os.Create(filepath.Join(dir, "huge"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.Truncate(int64(st.Total) + 1)
+	fd.Close()
+	s.PutCheckSpace("huge", "c/huge")
+	if _, err = os.Stat(filepath.Join(dir, "c")); !errors.Is(s.Error(), ErrInsufficientSpace) || !os.IsNotExist(err) {
+		t.Errorf("expect insufficient space before uploading, got %v", s.Error())
+	}
+
+	if _, err = LocalOnly().Rstatfs(dir); err != ErrStatfsUnsupported {
+		t.Errorf("expect unsupported error, got %v", err)
+	}
+}
+
+func TestFsSftpIsNoSpace(t *testing.T) {
+	var fs FsSftp
+	for _, c := range []struct {
+		err     error
+		noSpace bool
+	}{
+		{nil, false},
+		{&sftp.StatusError{Code: 14}, true},
+		{&sftp.StatusError{Code: 15}, true},
+		{&sftp.StatusError{Code: 4}, false},
+		{&os.PathError{Op: "write", Path: "/data", Err: syscall.ENOSPC}, true},
+		{errors.New("quota of api requests exceeded"), false},
+	} {
+		if got := fs.IsNoSpace(c.err); got != c.noSpace {
+			t.Errorf("%v: expect %t, got %t", c.err, c.noSpace, got)
+		}
+	}
+
+	// wrappers forward it and other Fs don't need to implement it
+	noSpace := &sftp.StatusError{Code: 14}
+	if !isNoSpace(newRetryFs(InstrumentedFs(fs, FileHooks{}), 3, 0), noSpace) {
+		t.Error("wrapped fs should recognize no space error")
+	}
+	if isNoSpace(struct{ Fs }{}, noSpace) {
+		t.Error("fs without IsNoSpace should never report no space")
+	}
+}
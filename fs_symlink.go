@@ -0,0 +1,73 @@
+package socker
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+// maxSymlinks is the max number of symbolic links followed by EvalSymlinks
+const maxSymlinks = 255
+
+var errTooManySymlinks = errors.New("too many levels of symbolic links")
+
+// EvalSymlinks is the same as filepath.EvalSymlinks but works for any Fs, path
+// must be absolute. The result is cleaned and contains no symbolic links.
+func EvalSymlinks(fs Fs, path string) (string, error) {
+	fp := fs.Filepath()
+	if !fp.IsAbs(path) {
+		return "", &os.PathError{Op: "evalsymlinks", Path: path, Err: errors.New("path is not absolute")}
+	}
+	vol := fp.VolumeName(path)
+	root := vol + string(fp.Separator())
+	split := func(p string) []string {
+		return strings.FieldsFunc(p, func(r rune) bool {
+			return r < 0x80 && fp.IsPathSeparator(uint8(r))
+		})
+	}
+
+	var (
+		resolved = root
+		comps    = split(path[len(vol):])
+		links    int
+	)
+	for len(comps) > 0 {
+		comp := comps[0]
+		comps = comps[1:]
+		switch comp {
+		case ".":
+			continue
+		case "..":
+			resolved = fp.Dir(resolved)
+			continue
+		}
+
+		next := fp.Join(resolved, comp)
+		stat, err := fs.Lstat(next)
+		if err != nil {
+			return "", err
+		}
+		if stat.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", &os.PathError{Op: "evalsymlinks", Path: path, Err: errTooManySymlinks}
+		}
+		target, err := fs.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if fp.IsAbs(target) {
+			if v := fp.VolumeName(target); v != "" {
+				root = v + string(fp.Separator())
+				target = target[len(v):]
+			}
+			resolved = root
+		}
+		comps = append(split(target), comps...)
+	}
+	return resolved, nil
+}
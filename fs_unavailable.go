@@ -0,0 +1,132 @@
+package socker
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+var ErrSFTPUnavailable = errors.New("sftp is unavailable for this connection")
+
+// fsUnavailable is used as the remote fs of command-only connections, every
+// operation fails with the error.
+type fsUnavailable struct {
+	fpath Filepath
+	err   error
+}
+
+var _ Fs = fsUnavailable{}
+
+func newFsUnavailable(err error) Fs {
+	var fpath Filepath = localFilepath{}
+	if os.PathSeparator != '/' {
+		fpath = virtualFilepath{
+			PathSeparator:     '/',
+			PathListSeparator: ':',
+			IsUnix:            true,
+		}
+	}
+	return fsUnavailable{fpath: fpath, err: err}
+}
+
+// isFsUnavailable report whether the fs, may be wrapped for retrying, is
+// unavailable.
+func isFsUnavailable(fs Fs) bool {
+	if rfs, ok := fs.(retryFs); ok {
+		fs = rfs.Fs
+	}
+	_, ok := fs.(fsUnavailable)
+	return ok
+}
+
+func (f fsUnavailable) Filepath() Filepath {
+	return f.fpath
+}
+
+func (f fsUnavailable) Chmod(name string, mode os.FileMode) error {
+	return f.err
+}
+
+func (f fsUnavailable) Chown(name string, uid, gid int) error {
+	return f.err
+}
+
+func (f fsUnavailable) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return f.err
+}
+
+func (f fsUnavailable) IsExist(err error) bool {
+	return os.IsExist(err)
+}
+
+func (f fsUnavailable) IsNotExist(err error) bool {
+	return os.IsNotExist(err)
+}
+
+func (f fsUnavailable) IsPermission(err error) bool {
+	return os.IsPermission(err)
+}
+
+func (f fsUnavailable) IsNoSpace(err error) bool {
+	return false
+}
+
+func (f fsUnavailable) Mkdir(name string, perm os.FileMode) error {
+	return f.err
+}
+
+func (f fsUnavailable) MkdirAll(path string, perm os.FileMode) error {
+	return f.err
+}
+
+func (f fsUnavailable) Readlink(name string) (string, error) {
+	return "", f.err
+}
+
+func (f fsUnavailable) Remove(name string) error {
+	return f.err
+}
+
+func (f fsUnavailable) RemoveAll(path string) error {
+	return f.err
+}
+
+func (f fsUnavailable) Rename(oldpath, newpath string) error {
+	return f.err
+}
+
+func (f fsUnavailable) SameFile(fi1, fi2 os.FileInfo) bool {
+	return os.SameFile(fi1, fi2)
+}
+
+func (f fsUnavailable) Symlink(oldname, newname string) error {
+	return f.err
+}
+
+func (f fsUnavailable) Truncate(name string, size int64) error {
+	return f.err
+}
+
+func (f fsUnavailable) Create(name string) (File, error) {
+	return nil, f.err
+}
+
+func (f fsUnavailable) Open(name string) (File, error) {
+	return nil, f.err
+}
+
+func (f fsUnavailable) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return nil, f.err
+}
+
+func (f fsUnavailable) Lstat(name string) (os.FileInfo, error) {
+	return nil, f.err
+}
+
+func (f fsUnavailable) Stat(name string) (os.FileInfo, error) {
+	return nil, f.err
+}
+
+func (f fsUnavailable) Close() error {
+	return nil
+}
@@ -0,0 +1,168 @@
+package socker
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+var (
+	ErrMaxDepthExceeded = errors.New("max depth of recursion exceeded")
+
+	// DefaultMaxDepth is the default max depth of recursive operations, it
+	// protects against loops of symbolic links and mounts.
+	DefaultMaxDepth = 256
+)
+
+// SyncFilter filter entries of tree operations such as Put, Get, Diff and Walk by
+// slash-separated paths relative to the tree root. Patterns without slash such
+// as ".git" and "*.tmp" match the base name at any level, others match the whole
+// relative path such as "build/*.o".
+//
+// Exclude takes precedence over Include. Excluded directories are pruned with
+// all their children. Include only applies to non-directories, directories are
+// always walked unless excluded, and all files are included if it's empty. The
+// tree root is never filtered.
+type SyncFilter struct {
+	Include []string
+	Exclude []string
+}
+
+// Accept report whether the entry should be kept, a nil filter accepts all.
+func (f *SyncFilter) Accept(relPath string, info os.FileInfo) bool {
+	if f == nil {
+		return true
+	}
+	if matchGlobs(f.Exclude, relPath) {
+		return false
+	}
+	if (info != nil && info.IsDir()) || len(f.Include) == 0 {
+		return true
+	}
+	return matchGlobs(f.Include, relPath)
+}
+
+func (f *SyncFilter) validate() error {
+	if f == nil {
+		return nil
+	}
+	err := checkGlobs(f.Include)
+	if err == nil {
+		err = checkGlobs(f.Exclude)
+	}
+	return err
+}
+
+// WalkFilter do the same thing as Walk but skip entries rejected by the filter,
+// fn is not called for them. The filter's patterns must be valid.
+func WalkFilter(fs Fs, root string, filter *SyncFilter, fn filepath.WalkFunc) error {
+	if err := filter.validate(); err != nil {
+		return err
+	}
+	fpath := fs.Filepath()
+	return Walk(fs, root, func(path string, info os.FileInfo, err error) error {
+		if path != root && err == nil {
+			rel, err := fpath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			if !filter.Accept(fpath.ToSlash(rel), info) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		return fn(path, info, err)
+	})
+}
+
+// Walk is the same as filepath.Walk but works for any Fs, fn can return
+// filepath.SkipDir to skip a directory. The depth is limited by DefaultMaxDepth.
+func Walk(fs Fs, root string, fn filepath.WalkFunc) error {
+	return WalkDepth(fs, root, DefaultMaxDepth, fn)
+}
+
+// walkProgressInterval is the count of entries between progress reports
+const walkProgressInterval = 100
+
+// WalkProgress do the same thing as Walk but call onProgress with the count of
+// entries walked so far every 100 entries and once more after the walk finished,
+// it's useful for feedback of long scans. onProgress can be nil.
+func WalkProgress(fs Fs, root string, onProgress func(count int), fn filepath.WalkFunc) error {
+	if onProgress == nil {
+		return Walk(fs, root, fn)
+	}
+	var count int
+	err := Walk(fs, root, func(path string, info os.FileInfo, err error) error {
+		count++
+		if count%walkProgressInterval == 0 {
+			onProgress(count)
+		}
+		return fn(path, info, err)
+	})
+	if count%walkProgressInterval != 0 {
+		onProgress(count)
+	}
+	return err
+}
+
+// WalkDepth do the same thing as Walk but return ErrMaxDepthExceeded if there
+// are entries deeper than maxDepth, the depth of root is 0. DefaultMaxDepth is
+// used if maxDepth is not positive.
+func WalkDepth(fs Fs, root string, maxDepth int, fn filepath.WalkFunc) error {
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxDepth
+	}
+	info, err := fs.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walk(fs, root, info, maxDepth, fn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func walk(fs Fs, path string, info os.FileInfo, depth int, fn filepath.WalkFunc) error {
+	if depth < 0 {
+		return ErrMaxDepthExceeded
+	}
+	if !info.IsDir() {
+		return fn(path, info, nil)
+	}
+
+	list, err := readdirSorted(fs, path)
+	err1 := fn(path, info, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+
+	fpath := fs.Filepath()
+	for _, fi := range list {
+		err = walk(fs, fpath.Join(path, fi.Name()), fi, depth-1, fn)
+		if err != nil {
+			if !fi.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readdirSorted(fs Fs, path string) ([]os.FileInfo, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	list, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byName(list))
+	return list, nil
+}
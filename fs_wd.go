@@ -2,6 +2,7 @@ package socker
 
 import (
 	"os"
+	"strings"
 	"time"
 )
 
@@ -12,6 +13,34 @@ func fsPath(fs Fs, wd, path string) string {
 	return fs.Filepath().Join(wd, path)
 }
 
+// safeJoin join name to base and make sure the result is still inside base,
+// ErrPathTraversal is returned otherwise.
+func safeJoin(fpath Filepath, base, name string) (string, error) {
+	base = fpath.Clean(base)
+	path := fpath.Join(base, name)
+	rel, err := fpath.Rel(base, path)
+	if err != nil {
+		return "", ErrPathTraversal
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(fpath.Separator())) {
+		return "", ErrPathTraversal
+	}
+	return path, nil
+}
+
+func expandHome(fs Fs, home, path string) string {
+	if home == "" || path == "" || path[0] != '~' {
+		return path
+	}
+	if len(path) == 1 {
+		return home
+	}
+	if path[1] != '/' && !fs.Filepath().IsPathSeparator(path[1]) {
+		return path
+	}
+	return fs.Filepath().Join(home, path[2:])
+}
+
 type wdFs struct {
 	wd string
 
@@ -57,6 +86,10 @@ func (f wdFs) IsPermission(err error) bool {
 	return f.fs.IsPermission(err)
 }
 
+func (f wdFs) IsNoSpace(err error) bool {
+	return isNoSpace(f.fs, err)
+}
+
 func (f wdFs) Mkdir(name string, perm os.FileMode) error {
 	return f.fs.Mkdir(f.path(name), perm)
 }
@@ -1,8 +1,13 @@
 module github.com/cosiner/socker
 
-go 1.10
+go 1.20
 
 require (
 	github.com/pkg/sftp v1.12.0
 	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 )
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+)
@@ -14,8 +14,12 @@ import (
 var (
 	ErrMuxClosed    = errors.New("mux has been closed")
 	ErrNoAuthMethod = errors.New("no auth method can be applied to agent")
+	ErrGateLoop     = errors.New("agent gates form a loop")
 )
 
+// GateNone is the gate value of AgentGates to connect without gate
+const GateNone = "none"
+
 // MuxAuth holds auth and gate configs
 type MuxAuth struct {
 	// AuthMethods holds all auth methods to destination host. The key can be any
@@ -26,16 +30,24 @@ type MuxAuth struct {
 	// only used if no auth method is matched for destination, can be empty.
 	DefaultAuth string
 	// AgentAuths define the rule which auth method is used to connect to destination host.
-	// The key is the format of "matcher:matchor", the value must be a key in
-	// AuthMethods field.
+	// The key is the format of "matcher:matchor" or "matcher@priority:matchor",
+	// the value must be a key in AuthMethods field.
 	AgentAuths map[string]string
 	// AgentGates define the rule which gate is used to connect to destination host.
-	// The key is the format of "matcher:matchor", the value must be an valid "host:port"
-	// like string.
+	// The key is the same as AgentAuths, the value must be an valid "host:port"
+	// like string, or GateNone to connect directly regardless of rules with lower
+	// priority.
 	AgentGates map[string]string
 
-	// KeepAliveSeconds limit the lifetime of idle ssh connection, default is 300.
+	// IdleReapSeconds limit the lifetime of idle cached connection, default is 300.
+	// It's not related to the TCP or server alive messages.
+	IdleReapSeconds int
+	// Deprecated: KeepAliveSeconds is an alias of IdleReapSeconds, it's used only
+	// if IdleReapSeconds is not set.
 	KeepAliveSeconds int
+	// MaxConcurrentDials limit the count of connections being established
+	// simultaneously, excess dials will wait. Zero or negative means no limit.
+	MaxConcurrentDials int
 }
 
 // ApplyDefaultHostCheck apply the checking function or ssh.InsecureIgnoreHostKey to each Auth instance.
@@ -50,6 +62,19 @@ func (a *MuxAuth) ApplyDefaultHostCheck(check ssh.HostKeyCallback) {
 	}
 }
 
+func (a *MuxAuth) idleReapDuration() time.Duration {
+	const defaultIdleReapSeconds = 300
+
+	seconds := a.IdleReapSeconds
+	if seconds <= 0 {
+		seconds = a.KeepAliveSeconds
+	}
+	if seconds <= 0 {
+		seconds = defaultIdleReapSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
 func (a *MuxAuth) checkAuth(id string, auth *Auth) error {
 	_, err := auth.SSHConfig()
 	if err != nil {
@@ -62,6 +87,9 @@ func (a *MuxAuth) checkAuth(id string, auth *Auth) error {
 }
 
 func (a *MuxAuth) Validate() error {
+	if len(a.AuthMethods) == 0 {
+		return errors.New("no auth method is configured, every dial would fail")
+	}
 	for id, auth := range a.AuthMethods {
 		err := a.checkAuth(id, auth)
 		if err != nil {
@@ -84,6 +112,31 @@ type priorityMatcher struct {
 	Priority int
 	Matcher
 	Value string
+
+	Rule    string
+	Pattern string
+}
+
+func newPriorityMatcher(addr, value string) (priorityMatcher, error) {
+	rule, pattern := SplitRuleAndAddr(addr)
+	name, priority, hasPriority, err := SplitRulePriority(rule)
+	if err != nil {
+		return priorityMatcher{}, err
+	}
+	matcher, defaultPriority, err := createMatcher(name, pattern)
+	if err != nil {
+		return priorityMatcher{}, err
+	}
+	if !hasPriority {
+		priority = defaultPriority
+	}
+	return priorityMatcher{
+		Matcher:  matcher,
+		Priority: priority,
+		Value:    value,
+		Rule:     name,
+		Pattern:  pattern,
+	}, nil
 }
 
 type byPriority []priorityMatcher
@@ -92,8 +145,16 @@ func (b byPriority) Len() int {
 	return len(b)
 }
 
+// Less order matchers by priority descending, the ties are ordered by rule and
+// pattern to make matching deterministic.
 func (b byPriority) Less(i, j int) bool {
-	return b[i].Priority > b[j].Priority
+	if b[i].Priority != b[j].Priority {
+		return b[i].Priority > b[j].Priority
+	}
+	if b[i].Rule != b[j].Rule {
+		return b[i].Rule < b[j].Rule
+	}
+	return b[i].Pattern < b[j].Pattern
 }
 
 func (b byPriority) Swap(i, j int) {
@@ -110,7 +171,15 @@ type Mux struct {
 
 	sshsMu sync.RWMutex
 	sshs   map[string]*SSH
+	// in-flight dials keyed by addr, protected by sshsMu
+	dialing map[string]*dialCall
+	// gate addr of cached connections dialed through gate, protected by sshsMu
+	gateOf map[string]string
+
+	dialSem chan struct{}
+	dialer  func(addr string, auth *Auth, gate ...*SSH) (*SSH, error)
 
+	idleReap  time.Duration
 	aliveChan chan struct{}
 }
 
@@ -133,15 +202,11 @@ func NewMux(auth MuxAuth) (*Mux, error) {
 	m.gates = make([]priorityMatcher, 0, len(auth.AgentGates))
 	for addr, gate := range auth.AgentGates {
 		if addr != "" && gate != "" {
-			matcher, priority, err := createMatcher(SplitRuleAndAddr(addr))
+			matcher, err := newPriorityMatcher(addr, gate)
 			if err != nil {
 				return nil, err
 			}
-			m.gates = append(m.gates, priorityMatcher{
-				Matcher:  matcher,
-				Priority: priority,
-				Value:    gate,
-			})
+			m.gates = append(m.gates, matcher)
 		}
 	}
 	sort.Sort(byPriority(m.gates))
@@ -150,46 +215,109 @@ func NewMux(auth MuxAuth) (*Mux, error) {
 	m.agents = make([]priorityMatcher, 0, len(auth.AgentAuths))
 	for addr, authID := range auth.AgentAuths {
 		if addr != "" && authID != "" {
-			matcher, priority, err := createMatcher(SplitRuleAndAddr(addr))
+			matcher, err := newPriorityMatcher(addr, authID)
 			if err != nil {
 				return nil, err
 			}
-
-			m.agents = append(m.agents, priorityMatcher{
-				Matcher:  matcher,
-				Priority: priority,
-				Value:    authID,
-			})
+			m.agents = append(m.agents, matcher)
 		}
 	}
 	sort.Sort(byPriority(m.agents))
 
 	m.sshs = make(map[string]*SSH)
-
-	const defaultKeepAliveSeconds = 300
-	if auth.KeepAliveSeconds <= 0 {
-		auth.KeepAliveSeconds = defaultKeepAliveSeconds
+	m.dialing = make(map[string]*dialCall)
+	m.gateOf = make(map[string]string)
+	m.dialer = Dial
+	if auth.MaxConcurrentDials > 0 {
+		m.dialSem = make(chan struct{}, auth.MaxConcurrentDials)
 	}
-	m.keepAlive(time.Duration(auth.KeepAliveSeconds) * defaultKeepAliveSeconds)
+
+	m.idleReap = auth.idleReapDuration()
+	m.keepAlive(m.idleReap)
 	return &m, nil
 }
 
-func (m *Mux) match(matchers []priorityMatcher, addr string) string {
-	var val string
+func (m *Mux) matchIndex(matchers []priorityMatcher, addr string) int {
 	for i := range matchers {
 		if matchers[i].Matcher(addr) {
-			val = matchers[i].Value
-			break
+			return i
 		}
 	}
-	return val
+	return -1
+}
+
+func (m *Mux) match(matchers []priorityMatcher, addr string) string {
+	i := m.matchIndex(matchers, addr)
+	if i < 0 {
+		return ""
+	}
+	return matchers[i].Value
+}
+
+// RouteRule is the rule matched by an address
+type RouteRule struct {
+	Matched  bool
+	Rule     string
+	Pattern  string
+	Priority int
+	// Value is the gate address, GateNone or auth method id
+	Value string
+}
+
+// RouteExplanation describe how an address is routed by Mux
+type RouteExplanation struct {
+	Gate RouteRule
+	Auth RouteRule
+	// DefaultAuth is true if no auth rule matched and the default auth is used
+	DefaultAuth bool
+}
+
+func (m *Mux) routeRule(matchers []priorityMatcher, addr string) RouteRule {
+	i := m.matchIndex(matchers, addr)
+	if i < 0 {
+		return RouteRule{}
+	}
+	return RouteRule{
+		Matched:  true,
+		Rule:     matchers[i].Rule,
+		Pattern:  matchers[i].Pattern,
+		Priority: matchers[i].Priority,
+		Value:    matchers[i].Value,
+	}
+}
+
+// ExplainRoute report the gate and auth rules matched by the address, it's
+// useful for debugging routing.
+func (m *Mux) ExplainRoute(addr string) RouteExplanation {
+	e := RouteExplanation{
+		Gate: m.routeRule(m.gates, addr),
+		Auth: m.routeRule(m.agents, addr),
+	}
+	e.DefaultAuth = !e.Auth.Matched && m.defaultAuthID != ""
+	return e
 }
 
 func (m *Mux) AgentGate(addr string) string {
 	gate := m.match(m.gates, addr)
+	if gate == GateNone {
+		return ""
+	}
 	return gate
 }
 
+// checkGateLoop follow the gates from addr and return ErrGateLoop if an address
+// is visited twice, dialing it would wait for itself forever.
+func (m *Mux) checkGateLoop(addr string) error {
+	visited := map[string]bool{addr: true}
+	for gate := m.AgentGate(addr); gate != ""; gate = m.AgentGate(gate) {
+		if visited[gate] {
+			return fmt.Errorf("%w: %s", ErrGateLoop, gate)
+		}
+		visited[gate] = true
+	}
+	return nil
+}
+
 func (m *Mux) AgentAuth(addr string) (*Auth, error) {
 	authID := m.match(m.agents, addr)
 	if authID == "" {
@@ -236,25 +364,147 @@ func (m *Mux) keepAlive(idle time.Duration) {
 }
 
 func (m *Mux) checkAlive(now time.Time, idle time.Duration) bool {
+	_, hasAlive := m.reap(now, idle)
+	return hasAlive
+}
+
+// ReapIdle close all connections which is not referenced and opened earlier than
+// the threshold, return the count of closed connections. Gates of kept
+// connections are never closed.
+func (m *Mux) ReapIdle(olderThan time.Duration) int {
+	reaped, _ := m.reap(time.Now(), olderThan)
+	return reaped
+}
+
+// ForEach call fn for each cached connection in order of addr, fn is called
+// with a snapshot outside the lock, so it's safe to call back into the Mux.
+func (m *Mux) ForEach(fn func(addr string, openAt time.Time, refs int32)) {
+	type conn struct {
+		addr   string
+		openAt time.Time
+		refs   int32
+	}
+	m.sshsMu.RLock()
+	conns := make([]conn, 0, len(m.sshs))
+	for addr, s := range m.sshs {
+		openAt, refs := s.Status()
+		conns = append(conns, conn{addr: addr, openAt: openAt, refs: refs})
+	}
+	m.sshsMu.RUnlock()
+
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].addr < conns[j].addr
+	})
+	for _, c := range conns {
+		fn(c.addr, c.openAt, c.refs)
+	}
+}
+
+// healthCheckConcurrency limit the count of connections pinged simultaneously
+const healthCheckConcurrency = 8
+
+// HealthCheck ping all cached connections concurrently and return the results
+// keyed by addr, nil for alive. Dead connections are evicted and closed.
+func (m *Mux) HealthCheck() map[string]error {
+	type conn struct {
+		addr string
+		s    *SSH
+	}
+	m.sshsMu.RLock()
+	conns := make([]conn, 0, len(m.sshs))
+	for addr, s := range m.sshs {
+		conns = append(conns, conn{addr: addr, s: s})
+	}
+	m.sshsMu.RUnlock()
+
 	var (
-		sshs     []*SSH
-		hasAlive bool
+		results = make(map[string]error, len(conns))
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, healthCheckConcurrency)
 	)
+	for _, c := range conns {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(c conn) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			err := c.s.Ping()
+			if err != nil {
+				m.evict(c.addr, c.s)
+			}
+			mu.Lock()
+			results[c.addr] = err
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+	return results
+}
+
+// evict remove the connection from cache and close it if it's still cached, the
+// connections dialed through it are evicted too.
+func (m *Mux) evict(addr string, s *SSH) {
+	var sshs []*SSH
+	m.sshsMu.Lock()
+	if m.sshs[addr] == s {
+		sshs = m.evictLocked(addr, nil)
+	}
+	m.sshsMu.Unlock()
+	closeEvicted(sshs)
+}
+
+func (m *Mux) reap(now time.Time, idle time.Duration) (reaped int, hasAlive bool) {
+	var sshs []*SSH
 	m.sshsMu.Lock()
+	// gates of connections being kept are kept too, since evicting a gate
+	// closes all connections dialed through it
+	kept := make(map[string]bool)
 	for addr, s := range m.sshs {
 		openAt, refs := s.Status()
-		if refs <= 0 && now.Sub(openAt) >= idle {
-			sshs = append(sshs, s)
-			delete(m.sshs, addr)
-		} else {
-			hasAlive = true
+		if refs > 0 || now.Sub(openAt) < idle {
+			for has := true; has && !kept[addr]; addr, has = m.gateOf[addr] {
+				kept[addr] = true
+			}
 		}
 	}
+	for addr := range m.sshs {
+		if !kept[addr] {
+			sshs = m.evictLocked(addr, sshs)
+		}
+	}
+	hasAlive = len(m.sshs) > 0
 	m.sshsMu.Unlock()
-	for _, s := range sshs {
-		s.Close()
+	closeEvicted(sshs)
+	return len(sshs), hasAlive
+}
+
+// evictLocked remove the connection of addr and all connections dialed through
+// it recursively from cache, the removed ones are appended to sshs to be closed
+// outside the lock.
+func (m *Mux) evictLocked(addr string, sshs []*SSH) []*SSH {
+	if s, has := m.sshs[addr]; has {
+		delete(m.sshs, addr)
+		sshs = append(sshs, s)
+	}
+	delete(m.gateOf, addr)
+	for agent, gate := range m.gateOf {
+		if gate == addr {
+			sshs = m.evictLocked(agent, sshs)
+		}
+	}
+	return sshs
+}
+
+// closeEvicted close connections in reverse order, so that agents are closed
+// before their gates.
+func closeEvicted(sshs []*SSH) {
+	for i := len(sshs) - 1; i >= 0; i-- {
+		sshs[i].Close()
 	}
-	return hasAlive
 }
 
 func (m *Mux) markClosed() bool {
@@ -281,56 +531,110 @@ func (m *Mux) Close() error {
 }
 
 func (m *Mux) Dial(addr string) (*SSH, error) {
-	if m.isClosed() {
-		return nil, ErrMuxClosed
+	for {
+		if m.isClosed() {
+			return nil, ErrMuxClosed
+		}
+
+		agent, call, leader := m.lookup(addr)
+		if agent != nil {
+			return agent, nil
+		}
+		if leader {
+			return m.dialLeader(addr, call)
+		}
+		// wait for the in-flight dial and look up the cache again
+		<-call.done
+		if call.err != nil {
+			return nil, call.err
+		}
 	}
+}
 
-	var (
-		agent *SSH
-		gate  *SSH
-		has   bool
+// dialCall is an in-flight dial, concurrent dials to the same addr wait for it
+// instead of opening duplicate connections.
+type dialCall struct {
+	done chan struct{}
+	err  error
+}
 
-		err error
-	)
+// lookup return the cached connection, or the in-flight dial of addr. A new dial
+// is registered if there is none, and the caller is the leader to finish it.
+func (m *Mux) lookup(addr string) (agent *SSH, call *dialCall, leader bool) {
+	m.sshsMu.Lock()
+	defer m.sshsMu.Unlock()
 
-	gateAddr := m.AgentGate(addr)
-	m.sshsMu.RLock()
-	agent, has = m.sshs[addr]
-	if !has {
-		if gateAddr != "" {
-			gate, has = m.sshs[gateAddr]
-			if has {
-				gate = gate.NopClose()
-			}
-		}
-	} else {
-		agent = agent.NopClose()
+	if agent, has := m.sshs[addr]; has {
+		return agent.NopClose(), nil, false
 	}
-	m.sshsMu.RUnlock()
-	if agent != nil {
-		return agent, nil
+	if call, has := m.dialing[addr]; has {
+		return nil, call, false
 	}
+	call = &dialCall{done: make(chan struct{})}
+	m.dialing[addr] = call
+	return nil, call, true
+}
+
+func (m *Mux) dialLeader(addr string, call *dialCall) (agent *SSH, err error) {
+	defer func() {
+		m.sshsMu.Lock()
+		delete(m.dialing, addr)
+		m.sshsMu.Unlock()
+		call.err = err
+		close(call.done)
+	}()
 
-	if gate == nil && gateAddr != "" {
+	if err = m.checkGateLoop(addr); err != nil {
+		return nil, err
+	}
+	var gate *SSH
+	gateAddr := m.AgentGate(addr)
+	if gateAddr != "" {
 		gate, err = m.Dial(gateAddr)
 		if err != nil {
 			return nil, err
 		}
-	}
-	if gate != nil {
 		defer gate.Close()
 	}
+	return m.dial(addr, gateAddr, gate)
+}
+
+// Warmup dial addresses concurrently and keep connections cached without
+// reference, the errors are in the same order of addresses, nil for success.
+func (m *Mux) Warmup(addrs []string) []error {
+	errs := make([]error, len(addrs))
+
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
 
-	return m.dial(addr, gate)
+			agent, err := m.Dial(addr)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			agent.Close()
+		}(i, addr)
+	}
+	wg.Wait()
+	return errs
 }
 
-func (m *Mux) dial(addr string, gate *SSH) (*SSH, error) {
+func (m *Mux) dial(addr, gateAddr string, gate *SSH) (*SSH, error) {
 	auth, err := m.AgentAuth(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	agent, err := Dial(addr, auth, gate)
+	if m.dialSem != nil {
+		m.dialSem <- struct{}{}
+	}
+	agent, err := m.dialer(addr, auth, gate)
+	if m.dialSem != nil {
+		<-m.dialSem
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -341,6 +645,9 @@ func (m *Mux) dial(addr string, gate *SSH) (*SSH, error) {
 		agent, tmp = tmp, agent
 	} else {
 		m.sshs[addr] = agent
+		if gateAddr != "" {
+			m.gateOf[addr] = gateAddr
+		}
 		if m.aliveChan != nil && !m.isClosed() {
 			select {
 			case m.aliveChan <- struct{}{}:
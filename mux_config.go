@@ -0,0 +1,221 @@
+package socker
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type sshConfigHost struct {
+	Patterns     []string
+	HostName     string
+	User         string
+	Port         string
+	IdentityFile string
+	ProxyJump    string
+}
+
+func (h *sshConfigHost) set(key, value string) {
+	// the first obtained value is used as ssh does
+	var field *string
+	switch strings.ToLower(key) {
+	case "hostname":
+		field = &h.HostName
+	case "user":
+		field = &h.User
+	case "port":
+		field = &h.Port
+	case "identityfile":
+		field = &h.IdentityFile
+	case "proxyjump":
+		field = &h.ProxyJump
+	default:
+		return
+	}
+	if *field == "" {
+		*field = value
+	}
+}
+
+func (h *sshConfigHost) isDefault() bool {
+	return len(h.Patterns) == 1 && h.Patterns[0] == "*"
+}
+
+func (h *sshConfigHost) matchAlias(alias string) bool {
+	for _, p := range h.Patterns {
+		if p == alias {
+			return true
+		}
+	}
+	return false
+}
+
+func parseSSHConfigHosts(path string) ([]*sshConfigHost, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var (
+		hosts   []*sshConfigHost
+		curr    *sshConfigHost
+		scanner = bufio.NewScanner(fd)
+		lineno  int
+	)
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		index := strings.IndexAny(line, " \t=")
+		if index < 0 {
+			return nil, fmt.Errorf("%s:%d: invalid line: %s", path, lineno, line)
+		}
+		key := line[:index]
+		value := strings.Trim(strings.TrimLeft(line[index:], " \t="), `"`)
+
+		switch strings.ToLower(key) {
+		case "host":
+			curr = &sshConfigHost{}
+			for _, p := range strings.Fields(value) {
+				// negated patterns are not supported by mux rules
+				if !strings.HasPrefix(p, "!") {
+					curr.Patterns = append(curr.Patterns, p)
+				}
+			}
+			hosts = append(hosts, curr)
+		case "match":
+			// unsupported, ignore its keywords
+			curr = nil
+		default:
+			if curr != nil {
+				curr.set(key, value)
+			}
+		}
+	}
+	return hosts, scanner.Err()
+}
+
+// sshConfigPatternRule convert ssh config host pattern to regexp rule, the address
+// can be with or without port.
+func sshConfigPatternRule(pattern string, priority int) string {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+	rule := RuleRegexp + "@" + strconv.Itoa(priority)
+	return JoinRuleAndAddr(rule, "^"+expr+`(:\d+)?$`)
+}
+
+func resolveSSHConfigJump(hosts []*sshConfigHost, jump string) string {
+	// only the first hop is used
+	if index := strings.IndexByte(jump, ','); index >= 0 {
+		jump = jump[:index]
+	}
+	if index := strings.LastIndexByte(jump, '@'); index >= 0 {
+		jump = jump[index+1:]
+	}
+	host, port, err := net.SplitHostPort(jump)
+	if err != nil {
+		host, port = jump, ""
+	}
+	for _, h := range hosts {
+		if h.matchAlias(host) {
+			if h.HostName != "" {
+				host = h.HostName
+			}
+			if port == "" {
+				port = h.Port
+			}
+			break
+		}
+	}
+	if port == "" {
+		port = "22"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// defaultIdentityFile return the first existing default private key of ssh
+func defaultIdentityFile() string {
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		path := expandLocalHome("~/.ssh/" + name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+func expandLocalHome(path string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return expandHome(FsLocal{}, home, path)
+}
+
+// ParseSSHConfig build MuxAuth from OpenSSH client config file. Host blocks are
+// converted to AuthMethods keyed by the Host line, User and IdentityFile are
+// used for auth and default private keys are used if IdentityFile is absent,
+// ProxyJump is used as gate and "ProxyJump none" is kept as GateNone. Both host
+// patterns and HostName are matched, earlier blocks have higher priority as ssh
+// does. The "Host *" block is used as default auth. Match blocks and negated
+// patterns are ignored.
+func ParseSSHConfig(path string) (MuxAuth, error) {
+	hosts, err := parseSSHConfigHosts(path)
+	if err != nil {
+		return MuxAuth{}, err
+	}
+
+	auth := MuxAuth{
+		AuthMethods: make(map[string]*Auth),
+		AgentAuths:  make(map[string]string),
+		AgentGates:  make(map[string]string),
+	}
+	for i, h := range hosts {
+		if len(h.Patterns) == 0 {
+			continue
+		}
+		priority := len(hosts) - i
+		id := strings.Join(h.Patterns, " ")
+		patterns := h.Patterns
+		if h.HostName != "" && !strings.ContainsAny(h.HostName, "%") {
+			patterns = append(patterns[:len(patterns):len(patterns)], h.HostName)
+		}
+
+		identityFile := h.IdentityFile
+		if identityFile == "" && h.User != "" {
+			identityFile = defaultIdentityFile()
+		}
+		if identityFile != "" {
+			auth.AuthMethods[id] = &Auth{
+				User:           h.User,
+				PrivateKeyFile: expandLocalHome(identityFile),
+			}
+			if h.isDefault() {
+				auth.DefaultAuth = id
+			} else {
+				for _, p := range patterns {
+					auth.AgentAuths[sshConfigPatternRule(p, priority)] = id
+				}
+			}
+		}
+		if h.ProxyJump != "" {
+			// "none" is kept to stop matching later blocks as ssh does
+			gate := GateNone
+			if h.ProxyJump != "none" {
+				gate = resolveSSHConfigJump(hosts, h.ProxyJump)
+			}
+			for _, p := range patterns {
+				auth.AgentGates[sshConfigPatternRule(p, priority)] = gate
+			}
+		}
+	}
+	return auth, nil
+}
@@ -0,0 +1,87 @@
+package socker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testSSHConfig = `
+# bastion
+Host bastion
+    HostName 10.0.1.1
+    Port 2222
+    User jump
+    IdentityFile KEYDIR/jump
+
+Host web-direct
+    ProxyJump none
+
+Host web-* db?
+    User deploy
+    IdentityFile KEYDIR/deploy
+    ProxyJump bastion
+
+Host *
+    User root
+    IdentityFile KEYDIR/default
+`
+
+func TestParseSSHConfig(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	pemBytes := testPrivateKey(t)
+	for _, name := range []string{"jump", "deploy", "default"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), pemBytes, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(dir, "config")
+	config := strings.Replace(testSSHConfig, "KEYDIR", dir, -1)
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := ParseSSHConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.DefaultAuth != "*" || auth.AuthMethods["*"].User != "root" {
+		t.Errorf("default auth failed: %s", auth.DefaultAuth)
+	}
+	if a := auth.AuthMethods["web-* db?"]; a == nil || a.User != "deploy" || a.PrivateKeyFile != filepath.Join(dir, "deploy") {
+		t.Errorf("host auth failed: %+v", a)
+	}
+
+	m, err := NewMux(auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	type testCase struct {
+		Addr string
+		Gate string
+		User string
+	}
+	cases := []testCase{
+		{Addr: "web-1:22", Gate: "10.0.1.1:2222", User: "deploy"},
+		{Addr: "db1", Gate: "10.0.1.1:2222", User: "deploy"},
+		{Addr: "web-direct", Gate: "", User: "deploy"},
+		{Addr: "db12", Gate: "", User: "root"},
+		{Addr: "10.0.1.1:2222", Gate: "", User: "jump"},
+		{Addr: "bastion", Gate: "", User: "jump"},
+	}
+	for _, c := range cases {
+		if gate := m.AgentGate(c.Addr); gate != c.Gate {
+			t.Errorf("gate match failed %s: expect %s, got %s", c.Addr, c.Gate, gate)
+		}
+		a, err := m.AgentAuth(c.Addr)
+		if err != nil || a.User != c.User {
+			t.Errorf("auth match failed %s: %v", c.Addr, err)
+		}
+	}
+}
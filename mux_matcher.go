@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -61,6 +62,20 @@ func SplitRuleAndAddr(s string) (rule, addr string) {
 	return s[:index], s[index+1:]
 }
 
+// SplitRulePriority split the priority override from rule such as "ipnet@90",
+// the registered priority of rule should be used if hasPriority is false.
+func SplitRulePriority(rule string) (name string, priority int, hasPriority bool, err error) {
+	index := strings.IndexByte(rule, '@')
+	if index < 0 {
+		return rule, 0, false, nil
+	}
+	priority, err = strconv.Atoi(rule[index+1:])
+	if err != nil {
+		return "", 0, false, fmt.Errorf("invalid priority of rule %s", rule)
+	}
+	return rule[:index], priority, true, nil
+}
+
 func JoinRuleAndAddr(rule, addr string) string {
 	return rule + ":" + addr
 }
@@ -117,8 +132,25 @@ func matchIPNet(cidr string) (Matcher, error) {
 	}, nil
 }
 
+// matchPlain compare the canonical host and port, the port matches anything if
+// it's omitted on either side.
 func matchPlain(addr string) (Matcher, error) {
+	host, port := splitPlainAddr(addr)
 	return func(dst string) bool {
-		return addr == dst
+		dstHost, dstPort := splitPlainAddr(dst)
+		return host == dstHost && (port == dstPort || port == "" || dstPort == "")
 	}, nil
 }
+
+// splitPlainAddr split addr to canonical host and port, the port is optional and
+// the IPv6 host can be bracketed or not.
+func splitPlainAddr(addr string) (host, port string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), ""
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), port
+	}
+	return strings.ToLower(host), port
+}
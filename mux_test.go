@@ -1,8 +1,13 @@
 package socker
 
 import (
+	"errors"
+	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestMatcheRegexp(t *testing.T) {
@@ -63,6 +68,37 @@ func TestMatchIPNet(t *testing.T) {
 	}
 }
 
+func TestMatchPlain(t *testing.T) {
+	type testCase struct {
+		Rule  string
+		Addr  string
+		Match bool
+	}
+
+	cases := []testCase{
+		{Rule: "127.0.0.1:22", Addr: "127.0.0.1:22", Match: true},
+		{Rule: "127.0.0.1:22", Addr: "127.0.0.1", Match: true},
+		{Rule: "127.0.0.1", Addr: "127.0.0.1:22", Match: true},
+		{Rule: "127.0.0.1:22", Addr: "127.0.0.1:2222", Match: false},
+		{Rule: "127.0.0.1:22", Addr: "127.0.0.2:22", Match: false},
+		{Rule: "[::1]:22", Addr: "::1", Match: true},
+		{Rule: "[::1]:22", Addr: "[::1]", Match: true},
+		{Rule: "::1", Addr: "[0:0::1]:22", Match: true},
+		{Rule: "[::1]:22", Addr: "[::1]:23", Match: false},
+		{Rule: "Example.com", Addr: "example.com:22", Match: true},
+	}
+
+	for i, c := range cases {
+		matcher, err := matchPlain(c.Rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matcher(c.Addr) != c.Match {
+			t.Errorf("test case failed: %d", i)
+		}
+	}
+}
+
 func TestPriority(t *testing.T) {
 	gates := map[string]string{
 		"ipnet:127.0.0.0/16":       "ipnet",
@@ -70,7 +106,8 @@ func TestPriority(t *testing.T) {
 		"regexp:127.0.0.\\d+:\\d+": "regexp",
 	}
 	m, err := NewMux(MuxAuth{
-		AgentGates: gates,
+		AuthMethods: testAuthMethods,
+		AgentGates:  gates,
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -84,10 +121,363 @@ func TestPriority(t *testing.T) {
 	if m.AgentGate("127.0.1.3:22") != "ipnet" {
 		t.Fatal("match failed")
 	}
+
+	route := m.ExplainRoute("127.0.0.2:22")
+	if !route.Gate.Matched || route.Gate.Rule != RuleRegexp || route.Gate.Pattern != "127.0.0.\\d+:\\d+" || route.Gate.Priority != 50 {
+		t.Errorf("explain gate failed: %+v", route.Gate)
+	}
+	if route.Auth.Matched || route.DefaultAuth {
+		t.Errorf("explain auth failed: %+v", route)
+	}
+}
+
+func TestIdleReapDuration(t *testing.T) {
+	type testCase struct {
+		Auth   MuxAuth
+		Expect time.Duration
+	}
+
+	cases := []testCase{
+		{Auth: MuxAuth{}, Expect: 300 * time.Second},
+		{Auth: MuxAuth{IdleReapSeconds: 30}, Expect: 30 * time.Second},
+		{Auth: MuxAuth{KeepAliveSeconds: 60}, Expect: 60 * time.Second},
+		{Auth: MuxAuth{IdleReapSeconds: 30, KeepAliveSeconds: 60}, Expect: 30 * time.Second},
+	}
+	for i, c := range cases {
+		c.Auth.AuthMethods = testAuthMethods
+		m, err := NewMux(c.Auth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.idleReap != c.Expect {
+			t.Errorf("test case failed: %d, got %s", i, m.idleReap)
+		}
+		m.Close()
+	}
+}
+
+func TestExplicitPriority(t *testing.T) {
+	m, err := NewMux(MuxAuth{
+		AuthMethods: testAuthMethods,
+		AgentGates: map[string]string{
+			"ipnet:10.0.0.0/8":     "broad",
+			"ipnet@10:10.1.0.0/16": "specific",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if gate := m.AgentGate("10.1.2.3"); gate != "specific" {
+		t.Errorf("explicit priority should win: %s", gate)
+	}
+	if gate := m.AgentGate("10.2.2.3"); gate != "broad" {
+		t.Errorf("registered priority should be used: %s", gate)
+	}
+	if route := m.ExplainRoute("10.1.2.3"); route.Gate.Rule != RuleIpnet || route.Gate.Priority != 10 {
+		t.Errorf("explain explicit priority failed: %+v", route.Gate)
+	}
+
+	_, err = NewMux(MuxAuth{
+		AuthMethods: testAuthMethods,
+		AgentGates:  map[string]string{"ipnet@high:10.0.0.0/8": "broad"},
+	})
+	if err == nil {
+		t.Error("invalid priority should be rejected")
+	}
+}
+
+func TestMuxNoAuthMethod(t *testing.T) {
+	_, err := NewMux(MuxAuth{AgentGates: map[string]string{"plain:10.0.0.1": "10.0.0.2"}})
+	if err == nil {
+		t.Error("mux without auth method should be rejected")
+	}
+}
+
+func TestMuxForEach(t *testing.T) {
+	m, err := NewMux(MuxAuth{AuthMethods: testAuthMethods})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	m.sshs["b:22"] = LocalOnly()
+	m.sshs["a:22"] = LocalOnly().NopClose()
+
+	var addrs []string
+	var refs []int32
+	m.ForEach(func(addr string, openAt time.Time, ref int32) {
+		// calling back into the Mux must not deadlock
+		m.ReapIdle(time.Hour)
+		addrs = append(addrs, addr)
+		refs = append(refs, ref)
+	})
+	if len(addrs) != 2 || addrs[0] != "a:22" || addrs[1] != "b:22" || refs[0] != 1 || refs[1] != 0 {
+		t.Errorf("unexpected connections: %v, %v", addrs, refs)
+	}
+}
+
+func TestMuxDialOnce(t *testing.T) {
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{"root": {User: "root", Password: "root"}},
+		DefaultAuth: "root",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	var dials int32
+	m.dialer = func(addr string, auth *Auth, gate ...*SSH) (*SSH, error) {
+		atomic.AddInt32(&dials, 1)
+		time.Sleep(50 * time.Millisecond)
+		return LocalOnly(), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			agent, err := m.Dial("10.0.0.1:22")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			agent.Close()
+		}()
+	}
+	wg.Wait()
+	if dials != 1 {
+		t.Errorf("expect exactly one dial, got %d", dials)
+	}
+}
+
+func TestMuxHealthCheck(t *testing.T) {
+	var execs int32
+	addr, closeFn := newTestSSHServer(t, &execs)
+	defer closeFn()
+
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{"root": {User: "root", Password: "root", NoSFTP: true}},
+		DefaultAuth: "root",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.dialer = func(_ string, auth *Auth, gate ...*SSH) (*SSH, error) {
+		return Dial(addr, auth, gate...)
+	}
+
+	m.Warmup([]string{"alive:22", "dead:22"})
+	dead, err := m.Dial("dead:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.conn.client.Close()
+
+	results := m.HealthCheck()
+	if len(results) != 2 || results["alive:22"] != nil || results["dead:22"] == nil {
+		t.Errorf("unexpected results: %v", results)
+	}
+	var addrs []string
+	m.ForEach(func(addr string, _ time.Time, _ int32) {
+		addrs = append(addrs, addr)
+	})
+	if len(addrs) != 1 || addrs[0] != "alive:22" {
+		t.Errorf("dead connection should be evicted: %v", addrs)
+	}
+}
+
+func TestMuxEvictGateDependents(t *testing.T) {
+	m, err := NewMux(MuxAuth{
+		AuthMethods: testAuthMethods,
+		DefaultAuth: "root",
+		AgentGates: map[string]string{
+			"plain:agent:22": "gate:22",
+			"plain:inner:22": "agent:22",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.dialer = func(addr string, auth *Auth, gate ...*SSH) (*SSH, error) {
+		return LocalOnly(), nil
+	}
+	cached := func() []string {
+		var addrs []string
+		m.ForEach(func(addr string, _ time.Time, _ int32) {
+			addrs = append(addrs, addr)
+		})
+		return addrs
+	}
+
+	m.Warmup([]string{"inner:22", "direct:22"})
+	if addrs := cached(); len(addrs) != 4 {
+		t.Fatalf("unexpected cached connections: %v", addrs)
+	}
+	m.sshsMu.RLock()
+	gate := m.sshs["gate:22"]
+	m.sshsMu.RUnlock()
+	m.evict("gate:22", gate)
+	if addrs := cached(); len(addrs) != 1 || addrs[0] != "direct:22" {
+		t.Errorf("agents behind evicted gate should be evicted: %v", addrs)
+	}
+
+	// the gate of agent in use is kept
+	agent, err := m.Dial("agent:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, addrs := m.ReapIdle(0), cached(); n != 1 || strings.Join(addrs, ",") != "agent:22,gate:22" {
+		t.Errorf("agent in use and its gate should be kept: %d, %v", n, addrs)
+	}
+	agent.Close()
+	if n := m.ReapIdle(0); n != 2 || len(cached()) != 0 {
+		t.Errorf("expect 2 reaped, got %d, %v", n, cached())
+	}
+}
+
+// blackholeListener accept connections but never speak ssh
+func blackholeListener(t *testing.T) (addr string, closeFn func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu    sync.Mutex
+		conns []net.Conn
+	)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	return ln.Addr().String(), func() {
+		ln.Close()
+		mu.Lock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+	}
+}
+
+func TestMuxAuthTimeout(t *testing.T) {
+	fastAddr, closeFast := blackholeListener(t)
+	defer closeFast()
+	slowAddr, closeSlow := blackholeListener(t)
+	defer closeSlow()
+
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{
+			"fast": {User: "root", Password: "root", TimeoutMs: 50},
+			"slow": {User: "root", Password: "root", TimeoutMs: 100},
+		},
+		AgentAuths: map[string]string{
+			"plain:" + fastAddr: "fast",
+			"plain:" + slowAddr: "slow",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	var (
+		mu       sync.Mutex
+		timeouts = make(map[string]int)
+	)
+	m.dialer = func(addr string, auth *Auth, gate ...*SSH) (*SSH, error) {
+		mu.Lock()
+		timeouts[addr] = auth.TimeoutMs
+		mu.Unlock()
+		return Dial(addr, auth, gate...)
+	}
+
+	for addr, expect := range map[string]int{fastAddr: 50, slowAddr: 100} {
+		_, err := m.Dial(addr)
+		if !errors.Is(err, ErrHandshakeTimeout) {
+			t.Errorf("%s: expect handshake timeout, got %v", addr, err)
+		}
+		mu.Lock()
+		if timeouts[addr] != expect {
+			t.Errorf("%s: expect timeout %dms, got %dms", addr, expect, timeouts[addr])
+		}
+		mu.Unlock()
+	}
+}
+
+func TestEqualPriority(t *testing.T) {
+	gates := map[string]string{
+		"regexp:^10\\.":      "a",
+		"regexp:^10\\.0\\.":  "b",
+		"regexp:^10\\.0\\.0": "c",
+		"regexp:\\.1$":       "d",
+	}
+	for i := 0; i < 20; i++ {
+		m, err := NewMux(MuxAuth{AuthMethods: testAuthMethods, AgentGates: gates})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gate := m.AgentGate("10.0.0.1"); gate != "d" {
+			t.Fatalf("equal priority match is not deterministic: %s", gate)
+		}
+		m.Close()
+	}
+}
+
+func TestMuxGateLoop(t *testing.T) {
+	m, err := NewMux(MuxAuth{
+		AuthMethods: testAuthMethods,
+		DefaultAuth: "root",
+		AgentGates: map[string]string{
+			"plain:10.0.0.1:22":   "10.0.0.1:22",
+			"plain:10.0.0.2:22":   "10.0.0.3:22",
+			"plain:10.0.0.3:22":   "10.0.0.2:22",
+			"plain:10.0.0.4:22":   "10.0.0.2:22",
+			"plain:10.0.0.5:22":   GateNone,
+			"regexp@1:^10\\.0\\.": "10.0.0.6:22",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	var dials int32
+	m.dialer = func(addr string, auth *Auth, gate ...*SSH) (*SSH, error) {
+		atomic.AddInt32(&dials, 1)
+		return nil, errors.New("unreachable")
+	}
+	for _, addr := range []string{"10.0.0.1:22", "10.0.0.2:22", "10.0.0.4:22"} {
+		if _, err := m.Dial(addr); !errors.Is(err, ErrGateLoop) {
+			t.Errorf("%s: expect gate loop error, got %v", addr, err)
+		}
+	}
+	if dials != 0 {
+		t.Errorf("nothing should be dialed for gate loops, got %d", dials)
+	}
+	if gate := m.AgentGate("10.0.0.5:22"); gate != "" {
+		t.Errorf("GateNone should stop rules of lower priority, got %s", gate)
+	}
+	if _, err := m.Dial("10.0.0.5:22"); err == nil || errors.Is(err, ErrGateLoop) || dials != 1 {
+		t.Errorf("expect dialed directly, got %v", err)
+	}
 }
 
 var auth = &Auth{User: "root", Password: "root"}
 
+var testAuthMethods = map[string]*Auth{"root": auth}
+
 func TestGate(t *testing.T) {
 	gate, err := Dial("10.0.1.1", auth)
 	if err != nil {
@@ -0,0 +1,46 @@
+package socker
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Shell describe the platform specific command syntax of a host
+type Shell struct {
+	// NullDevice is the file discards all data, such as /dev/null and NUL.
+	NullDevice string
+	// BgFormat is the format of running a command in background, the arguments are
+	// command, stdout file, stderr file and stdin file in order, stderr is "&1"
+	// if it's redirected to stdout.
+	BgFormat string
+	// BgPid is the command appended to the background command to print the pid
+	// of it, empty if unsupported.
+	BgPid string
+}
+
+var (
+	ShellUnix = Shell{
+		NullDevice: "/dev/null",
+		BgFormat:   "nohup %[1]s >%[2]s 2>%[3]s <%[4]s &",
+		BgPid:      "echo $!",
+	}
+	ShellWindows = Shell{
+		NullDevice: "NUL",
+		BgFormat:   "start /b %[1]s >%[2]s 2>%[3]s <%[4]s",
+	}
+)
+
+func (s Shell) cmdStrBg(cmd, stdout, stderr string) string {
+	if stdout == "" {
+		stdout = "nohup.out"
+	}
+	if stderr == "" || stderr == stdout {
+		stderr = "&1"
+	}
+	return fmt.Sprintf(s.BgFormat, cmd, stdout, stderr, s.NullDevice)
+}
+
+// shellQuote quote the string as a single argument of POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,23 @@
+package socker
+
+import "testing"
+
+func TestShellCmdStrBg(t *testing.T) {
+	type testCase struct {
+		Shell          Shell
+		Stdout, Stderr string
+		Expect         string
+	}
+
+	cases := []testCase{
+		{Shell: ShellUnix, Expect: "nohup sleep 30 >nohup.out 2>&1 </dev/null &"},
+		{Shell: ShellUnix, Stdout: "out", Stderr: "err", Expect: "nohup sleep 30 >out 2>err </dev/null &"},
+		{Shell: ShellWindows, Stdout: "out", Stderr: "out", Expect: "start /b sleep 30 >out 2>&1 <NUL"},
+		{Shell: ShellWindows, Stdout: "out", Stderr: "err", Expect: "start /b sleep 30 >out 2>err <NUL"},
+	}
+	for i, c := range cases {
+		if got := c.Shell.cmdStrBg("sleep 30", c.Stdout, c.Stderr); got != c.Expect {
+			t.Errorf("test case failed: %d, got %s", i, got)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package socker
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -11,6 +13,7 @@ import (
 	"os/exec"
 	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -18,7 +21,14 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-var ErrConnClosed = errors.New("connection closed")
+var (
+	ErrConnClosed           = errors.New("connection closed")
+	ErrReconnectUnsupported = errors.New("connection is not dialed by address or is a NopClose clone")
+	ErrWaitTimeout          = errors.New("wait timeout")
+	ErrUnexpectedExitCode   = errors.New("unexpected exit code")
+	ErrDialTimeout          = errors.New("dial timeout")
+	ErrHandshakeTimeout     = errors.New("ssh handshake timeout")
+)
 
 type SSH struct {
 	lastErr    error
@@ -29,10 +39,21 @@ type SSH struct {
 	lOut, lErr io.Writer
 
 	nopClose bool
-
-	conn        *ssh.Client
-	sftp        *sftp.Client
-	sessionPool *sessionPool
+	safePath bool
+	noAutoCd bool
+	// separator chaining cd, export and the command, CmdSeperator is used if empty
+	cmdSep string
+	// max depth of recursive operations, DefaultMaxDepth is used if not positive
+	maxDepth int
+	// mode of auto-created directories, 0755 is used if zero
+	dirMode os.FileMode
+	// reconnect and retry remote commands on transport errors
+	autoReconnect bool
+	// tokens of concurrent file transfers, unlimited if nil
+	transfers chan struct{}
+
+	// connection shared by clones, see sshConn
+	conn *sshConn
 
 	// absolute fs
 	rfs Fs
@@ -41,20 +62,79 @@ type SSH struct {
 	// current work dir
 	rwd string
 	cwd string
+	// command syntax
+	rshell Shell
+	lshell Shell
+
+	// home dir used to expand ~
+	rhome string
+	lhome string
+
+	// persistent env of commands
+	renv map[string]string
+	lenv map[string]string
+	// wrapper of remote commands
+	rwrap func(cmd string) string
+	// directory of temporary files, see SetRemoteTempDir
+	rtmpDir *remoteTempDir
+
+	gate  *SSH
+	_refs *int32
+
+	// pids of background jobs shared by clones, see CloseKillBackground
+	bgJobs *bgJobs
+
+	// dial info for reconnect
+	addr string
+	auth *Auth
+}
+
+// sshConn is the connection shared by an instance and all its clones, Reconnect
+// replaces the fields in place so that clones use the new connection too. mu is
+// held for reading by operations and for writing by Reconnect.
+type sshConn struct {
+	mu          sync.RWMutex
+	client      *ssh.Client
+	sftp        *sftp.Client
+	sessionPool *sessionPool
+	openAt      time.Time
+	idle        *idleTimer
+}
+
+func newSSHConn(client *ssh.Client, sftpClient *sftp.Client, maxSession int) *sshConn {
+	return &sshConn{
+		client:      client,
+		sftp:        sftpClient,
+		sessionPool: newSessionPool(maxSession),
+		openAt:      time.Now(),
+	}
+}
 
-	gate   *SSH
-	openAt time.Time
-	_refs  *int32
+func (c *sshConn) close() {
+	if c.sessionPool != nil {
+		c.sessionPool.Close()
+	}
+	if c.sftp != nil {
+		c.sftp.Close()
+	}
+	if c.client != nil {
+		c.client.Close()
+	}
 }
 
 func LocalOnly() *SSH {
 	var refs int32
+	home, _ := os.UserHomeDir()
 	return &SSH{
-		lfs:         FsLocal{},
-		rfs:         FsLocal{},
-		sessionPool: newSessionPool(0),
-		openAt:      time.Now(),
-		_refs:       &refs,
+		conn:   newSSHConn(nil, nil, 0),
+		lfs:    FsLocal{},
+		rfs:    FsLocal{},
+		rshell: ShellUnix,
+		lshell: ShellUnix,
+		rhome:  home,
+		lhome:  home,
+		_refs:  &refs,
+		bgJobs: &bgJobs{},
 	}
 }
 
@@ -63,32 +143,119 @@ func NewSSH(client *ssh.Client, maxSession int, gate *SSH) (*SSH, error) {
 	if err != nil {
 		return nil, err
 	}
+	return newSSH(client, sftpClient, maxSession, gate, "", "")
+}
+
+// NewSSHCmdOnly create a SSH instance without sftp client, it's useful for
+// command-only workloads or servers without sftp subsystem. All remote file
+// operations will fail with ErrSFTPUnavailable.
+func NewSSHCmdOnly(client *ssh.Client, maxSession int, gate *SSH) (*SSH, error) {
+	return newSSH(client, nil, maxSession, gate, "", "")
+}
+
+func newSSHWithAuth(client *ssh.Client, auth *Auth, gate *SSH) (*SSH, error) {
+	var (
+		sftpClient *sftp.Client
+		err        error
+	)
+	switch {
+	case auth.NoSFTP:
+	case auth.SftpSubsystem != "":
+		sftpClient, err = newSftpClientSubsystem(client, auth.SftpSubsystem)
+	default:
+		sftpClient, err = sftp.NewClient(client)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := newSSH(client, sftpClient, auth.MaxSession, gate, auth.RemoteWorkDir, auth.LocalWorkDir)
+	if err != nil {
+		return nil, err
+	}
+	s.rwrap = auth.CommandWrapper
+	return s, nil
+}
+
+func newSftpClientSubsystem(client *ssh.Client, subsystem string) (*sftp.Client, error) {
+	sess, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	w, err := sess.StdinPipe()
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	r, err := sess.StdoutPipe()
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	err = sess.RequestSubsystem(subsystem)
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	sftpClient, err := sftp.NewClientPipe(r, w)
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	return sftpClient, nil
+}
 
+// newSSH create the instance, rwd and lwd override the initial working
+// directories if not empty.
+func newSSH(client *ssh.Client, sftpClient *sftp.Client, maxSession int, gate *SSH, rwd, lwd string) (*SSH, error) {
 	var refs int32
 	s := &SSH{
-		conn:        client,
-		sftp:        sftpClient,
-		sessionPool: newSessionPool(maxSession),
+		conn: newSSHConn(client, sftpClient, maxSession),
 
-		rfs: NewFsSftp(sftpClient),
 		lfs: FsLocal{},
 
+		rshell: ShellUnix,
+		lshell: ShellUnix,
+
 		gate:   gate,
-		openAt: time.Now(),
 		_refs:  &refs,
+		bgJobs: &bgJobs{},
 	}
-	if err == nil {
+	if sftpClient != nil {
+		s.rfs = newConnFsSftp(s.conn)
+	} else {
+		s.rfs = newFsUnavailable(ErrSFTPUnavailable)
+	}
+
+	s.lhome, _ = os.UserHomeDir()
+
+	var err error
+	s.cwd = lwd
+	if s.cwd == "" {
 		s.cwd, err = os.Getwd()
-		if err == nil && !s.lfs.Filepath().IsAbs(s.cwd) {
-			err = fmt.Errorf("local work dir is not absolute: %s", s.cwd)
-		}
 	}
-	if err == nil {
-		s.rwd, err = sftpClient.Getwd()
-		if err == nil && !s.rfs.Filepath().IsAbs(s.rwd) {
-			err = fmt.Errorf("remote work dir is not absolute: %s", s.rwd)
+	if err == nil && !s.lfs.Filepath().IsAbs(s.cwd) {
+		err = fmt.Errorf("local work dir is not absolute: %s", s.cwd)
+	}
+	if err == nil && sftpClient != nil {
+		// sftp server starts at the login directory
+		s.rhome, err = sftpClient.Getwd()
+		if err == nil && s.rhome == "" {
+			// some noncompliant servers return empty path
+			s.rhome = "/"
+		}
+		if rwd != "" {
+			if err != nil || !s.rfs.Filepath().IsAbs(s.rhome) {
+				s.rhome, err = rwd, nil
+			}
+		} else {
+			rwd = s.rhome
 		}
 	}
+	s.rwd = rwd
+	if err == nil && s.rwd != "" && !s.rfs.Filepath().IsAbs(s.rwd) {
+		err = fmt.Errorf("remote work dir is not absolute: %s", s.rwd)
+	}
 	if err != nil {
 		s.Close()
 		return nil, fmt.Errorf("get remote/local working directory failed: %w", err)
@@ -106,48 +273,162 @@ func Dial(addr string, auth *Auth, gate ...*SSH) (*SSH, error) {
 		return nil, err
 	}
 
-	client, err := ssh.Dial("tcp", addr, config)
+	client, err := dialSSH(addr, auth, config)
 	if err != nil {
 		return nil, err
 	}
 
-	s, err := NewSSH(client, auth.MaxSession, nil)
+	s, err := newSSHWithAuth(client, auth, nil)
 	if err != nil {
 		client.Close()
 		return nil, err
 	}
+	s.addr, s.auth = addr, auth
 	return s, nil
 }
 
+func dialSSH(addr string, auth *Auth, config *ssh.ClientConfig) (*ssh.Client, error) {
+	localAddr, err := auth.localTCPAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := net.Dialer{Timeout: config.Timeout}
+	if localAddr != nil {
+		dialer.LocalAddr = localAddr
+	}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newClientConn(conn, addr, config)
+}
+
+// newClientConn establish ssh connection on conn, the handshake is limited by
+// config.Timeout if it's positive. conn is closed if failed.
+func newClientConn(conn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	var timer *time.Timer
+	if config.Timeout > 0 {
+		// closing conn is the only way to abort the handshake
+		timer = time.AfterFunc(config.Timeout, func() { conn.Close() })
+	}
+	// the handshake error only keeps the message of host key error, record it
+	// so callers can inspect errors such as *HostKeyMismatchError.
+	var hostKeyErr error
+	if check := config.HostKeyCallback; check != nil {
+		cfg := *config
+		cfg.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKeyErr = check(hostname, remote, key)
+			return hostKeyErr
+		}
+		config = &cfg
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if timer != nil && !timer.Stop() {
+		if err == nil {
+			c.Close()
+		}
+		return nil, fmt.Errorf("%w: %s", ErrHandshakeTimeout, addr)
+	}
+	if err != nil {
+		conn.Close()
+		if hostKeyErr != nil {
+			err = fmt.Errorf("ssh: handshake failed: %w", hostKeyErr)
+		}
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// dialTimeout call dial and return ErrDialTimeout if it doesn't finish in
+// timeout, the late connection is closed.
+func dialTimeout(dial func() (net.Conn, error), addr string, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 {
+		return dial()
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := dial()
+		ch <- result{conn: conn, err: err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-timer.C:
+		go func() {
+			if r := <-ch; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("%w: %s", ErrDialTimeout, addr)
+	}
+}
+
 func (s *SSH) DialConn(net, addr string) (net.Conn, error) {
-	return s.conn.Dial(net, addr)
+	return s.dialBusy(net, addr)
 }
 
 func (s *SSH) Dial(addr string, auth *Auth) (*SSH, error) {
-	conn, err := s.conn.Dial("tcp", addr)
+	config, err := auth.SSHConfig()
 	if err != nil {
 		return nil, err
 	}
-	config, err := auth.SSHConfig()
+	conn, err := dialTimeout(func() (net.Conn, error) {
+		return s.dialBusy("tcp", addr)
+	}, addr, config.Timeout)
 	if err != nil {
 		return nil, err
 	}
 
-	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	client, err := newClientConn(conn, addr, config)
 	if err != nil {
-		conn.Close()
 		return nil, err
 	}
-
-	client := ssh.NewClient(c, chans, reqs)
-	ssh, err := NewSSH(client, auth.MaxSession, s.NopClose())
+	ssh, err := newSSHWithAuth(client, auth, s.NopClose())
 	if err != nil {
 		client.Close()
 		return nil, err
 	}
+	ssh.addr, ssh.auth = addr, auth
 	return ssh, nil
 }
 
+// Reconnect re-dial the destination through the same gate and replace the
+// connection, working directories and pipe settings are preserved. The remote
+// Fs set by SetRemoteFs, SetFsRetry or wrappers such as InstrumentedFs is kept,
+// only the sftp client underneath is replaced. Clones share the connection, so
+// they use the new one as well. Operations will wait until reconnect finished.
+func (s *SSH) Reconnect() error {
+	if s.auth == nil || s.nopClose {
+		return ErrReconnectUnsupported
+	}
+	ns, err := Dial(s.addr, s.auth, s.gate)
+	if err != nil {
+		return err
+	}
+	if ns.gate != nil {
+		// reuse the gate reference of current instance
+		ns.gate.decrRefs()
+	}
+
+	c, nc := s.conn, ns.conn
+	c.mu.Lock()
+	if c.idle != nil {
+		c.idle.Stop()
+		c.idle = newIdleTimer(c.idle.timeout, c.close)
+	}
+	c.close()
+	c.client, c.sftp, c.sessionPool, c.openAt = nc.client, nc.sftp, nc.sessionPool, nc.openAt
+	c.mu.Unlock()
+	return nil
+}
+
 func (s *SSH) incrRefs() int32 {
 	return atomic.AddInt32(s._refs, 1)
 }
@@ -157,7 +438,49 @@ func (s *SSH) decrRefs() int32 {
 }
 
 func (s *SSH) Status() (openAt time.Time, refs int32) {
-	return s.openAt, atomic.LoadInt32(s._refs)
+	s.conn.mu.RLock()
+	openAt = s.conn.openAt
+	s.conn.mu.RUnlock()
+	return openAt, atomic.LoadInt32(s._refs)
+}
+
+// pingTimeout is the max duration waiting for the reply of Ping
+const pingTimeout = 10 * time.Second
+
+// Ping send a keepalive request and wait for the reply to check whether the
+// connection is alive, ErrWaitTimeout is returned if the server doesn't reply in
+// time. The reply is not required to be successful.
+func (s *SSH) Ping() error {
+	s.conn.mu.RLock()
+	defer s.conn.mu.RUnlock()
+	if s.conn.client == nil {
+		return ErrConnClosed
+	}
+	conn := s.conn.client
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+		errCh <- err
+	}()
+	timer := time.NewTimer(pingTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-errCh:
+		return err
+	case <-timer.C:
+		return ErrWaitTimeout
+	}
+}
+
+// Gate return the gate the connection is dialed through, nil if it's direct. The
+// gate is owned by the connection and should not be closed by caller.
+func (s *SSH) Gate() *SSH {
+	return s.gate
+}
+
+// ViaGate report whether the connection is dialed through a gate
+func (s *SSH) ViaGate() bool {
+	return s.gate != nil
 }
 
 func (s *SSH) clean() {
@@ -165,7 +488,16 @@ func (s *SSH) clean() {
 	s.lastOutput = nil
 }
 
-// Closed should be called only if reference count is zero or it's Cloned by NopClose
+// CloseResult do the same thing as Close but return the last output and error
+// before they are cleaned, it's useful for deferred close.
+func (s *SSH) CloseResult() ([]byte, error) {
+	output, err := s.lastOutput, s.lastErr
+	s.Close()
+	return output, err
+}
+
+// Closed should be called only if reference count is zero or it's Cloned by NopClose.
+// The last output and error is cleaned, read them before or use CloseResult.
 func (s *SSH) Close() {
 	s.clean()
 	if s.nopClose {
@@ -175,15 +507,20 @@ func (s *SSH) Close() {
 	if s.gate != nil {
 		s.gate.decrRefs()
 	}
-	if s.sessionPool != nil {
-		s.sessionPool.Close()
-	}
-	if s.sftp != nil {
-		s.sftp.Close()
-	}
-	if s.conn != nil {
-		s.conn.Close()
+	if s.conn.idle != nil {
+		s.conn.idle.Stop()
 	}
+	s.conn.close()
+}
+
+// SetRemoteShell change the command syntax of remote host, default is ShellUnix
+func (s *SSH) SetRemoteShell(shell Shell) {
+	s.rshell = shell
+}
+
+// SetLocalShell do the same thing as SetRemoteShell but for local host
+func (s *SSH) SetLocalShell(shell Shell) {
+	s.lshell = shell
 }
 
 func (s *SSH) RemotePipeInput(stdin io.Reader) {
@@ -194,6 +531,8 @@ func (s *SSH) LocalPipeInput(stdin io.Reader) {
 	s.lIn = stdin
 }
 
+// RemotePipeOutput set the writers of remote command output, Output returns
+// nothing for succeeded commands but the tail of output for failed ones.
 func (s *SSH) RemotePipeOutput(stdout, stderr io.Writer) {
 	s.rOut = stdout
 	s.rErr = stderr
@@ -204,9 +543,116 @@ func (s *SSH) LocalPipeOutput(stdout, stderr io.Writer) {
 	s.lErr = stderr
 }
 
+// withReconnect do the same thing as withErrorCheck, but reconnect and retry
+// once on transport errors if auto reconnect is enabled.
+func (s *SSH) withReconnect(fn func() error) {
+	if s.lastErr != nil {
+		return
+	}
+	s.withErrorCheck(fn)
+	if !s.autoReconnect || !isTransportError(s.lastErr) {
+		return
+	}
+	if s.Reconnect() == nil {
+		s.lastErr = nil
+		s.withErrorCheck(fn)
+	}
+}
+
+// isTransportError report whether the error is caused by the connection instead
+// of the command.
+func isTransportError(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch err.(type) {
+	case *ssh.ExitError, *ssh.ExitMissingError:
+		return false
+	case net.Error:
+		return true
+	}
+	return err == ErrConnClosed || err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed)
+}
+
 func (s *SSH) withErrorCheck(fn func() error) {
-	if s.lastErr == nil {
-		s.lastErr = fn()
+	if s.lastErr != nil {
+		return
+	}
+	s.lastErr = s.guarded(fn)
+}
+
+// guarded call fn with the connection locked against reconnecting and the idle
+// timer stopped, it's used by operations returning errors directly instead of
+// chaining them.
+func (s *SSH) guarded(fn func() error) error {
+	s.conn.mu.RLock()
+	defer s.conn.mu.RUnlock()
+	end, err := s.busy()
+	if err != nil {
+		return err
+	}
+	defer end()
+	return fn()
+}
+
+// busy stop the idle timer until end is called, ErrConnClosed is returned if
+// the connection has been closed for idle. All operations using the connection
+// must call it.
+func (s *SSH) busy() (end func(), err error) {
+	idle := s.conn.idle
+	if idle == nil {
+		return func() {}, nil
+	}
+	if !idle.begin() {
+		return nil, ErrConnClosed
+	}
+	return idle.end, nil
+}
+
+// idleConn end the busy state of idle timer once it's closed
+type idleConn struct {
+	net.Conn
+	once sync.Once
+	end  func()
+}
+
+func (c *idleConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.end)
+	return err
+}
+
+// dialBusy dial through the connection, the idle timer is stopped until the
+// returned connection is closed.
+func (s *SSH) dialBusy(network, addr string) (net.Conn, error) {
+	if s.conn.client == nil {
+		return nil, ErrConnClosed
+	}
+	end, err := s.busy()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := s.conn.client.Dial(network, addr)
+	if err != nil {
+		end()
+		return nil, err
+	}
+	return &idleConn{Conn: conn, end: end}, nil
+}
+
+// SetIdleTimeout close the connection if there is no command or transfer running
+// for the duration, open tunnels and forwards are also counted as running.
+// Subsequent operations will fail with ErrConnClosed. Zero or
+// negative duration disable it. It's designed for standalone usage, the connections
+// managed by Mux are reaped by Mux.
+func (s *SSH) SetIdleTimeout(d time.Duration) {
+	c := s.conn
+	if c.idle != nil {
+		c.idle.Stop()
+		c.idle = nil
+	}
+	if d > 0 {
+		c.idle = newIdleTimer(d, c.close)
 	}
 }
 
@@ -216,7 +662,7 @@ func (s *SSH) Error() error {
 
 // save error state from external, such as fs op
 func (s *SSH) SetError(err error) {
-	s.lastErr = s.lastErr
+	s.lastErr = err
 }
 
 func (s *SSH) ClearError() {
@@ -227,6 +673,26 @@ func (s *SSH) Output() []byte {
 	return s.lastOutput
 }
 
+// ExitCode return the exit code of last failed command, it's 0 if there is no
+// error and -1 if the error is not caused by command exit, such as connection
+// failure or context cancellation.
+func (s *SSH) ExitCode() int {
+	return exitCode(s.lastErr)
+}
+
+func exitCode(err error) int {
+	switch err := err.(type) {
+	case nil:
+		return 0
+	case *ssh.ExitError:
+		return err.ExitStatus()
+	case *exec.ExitError:
+		return err.ExitCode()
+	default:
+		return -1
+	}
+}
+
 // NopClose create a clone of current SSH instance and increase the reference count.
 // The Close method of returned instance will do nothing but decrease parent reference count.
 func (s *SSH) NopClose() *SSH {
@@ -242,142 +708,901 @@ func (s *SSH) NopClose() *SSH {
 	return &ns
 }
 
-func (s *SSH) Lfs() Fs {
-	return newWdFs(s.cwd, s.lfs)
+// Derive create a clone for independent use such as a goroutine of fan-out,
+// and increase the reference count. The clone shares the connection, sftp
+// client, session pool, transfer limit and gate with current instance, its Close
+// only decrease the reference count. The error and output, pipes (reset to
+// default), working directories, env and other settings are independent. Unlike
+// NopClose, a new clone is always created even if current instance is a clone.
+// Reconnect is unsupported for the clone, but reconnects of current instance
+// apply to it.
+func (s *SSH) Derive() *SSH {
+	s.incrRefs()
+	ns := *s
+	ns.clean()
+	ns.nopClose = true
+	ns.rIn, ns.rOut, ns.rErr = nil, nil, nil
+	ns.lIn, ns.lOut, ns.lErr = nil, nil, nil
+	if ns.renv != nil {
+		ns.renv = copyEnv(ns.renv)
+	}
+	if ns.lenv != nil {
+		ns.lenv = copyEnv(ns.lenv)
+	}
+	return &ns
 }
 
-func (s *SSH) Rfs() Fs {
-	return newWdFs(s.rwd, s.rfs)
+// SetAutoReconnect enable reconnecting and retrying once for remote commands
+// failed by transport errors such as dropped connection, the command exit errors
+// are never retried. It only works for connections created by Dial.
+func (s *SSH) SetAutoReconnect(enable bool) {
+	s.autoReconnect = enable
 }
 
-func (s *SSH) Rcmd(cmd string, env ...string) {
-	s.withErrorCheck(func() error {
-		return s.runRcmd(cmd, env...)
-	})
+// SetCmdSeparator set the separator chaining the cd, export and the command
+// for this instance, such as "&&" to stop on error or ";" to continue. The
+// package-level CmdSeperator is used if it's empty.
+func (s *SSH) SetCmdSeparator(sep string) {
+	s.cmdSep = sep
 }
 
-func (s *SSH) Lcmd(cmd string, env ...string) {
-	s.withErrorCheck(func() error {
-		return s.runLcmd(cmd, env...)
-	})
+func (s *SSH) cmdSeparator() string {
+	if s.cmdSep == "" {
+		return CmdSeperator
+	}
+	return s.cmdSep
 }
 
-func (s *SSH) RcmdBg(cmd, stdout, stderr string, env ...string) {
-	s.Rcmd(s.cmdStrBg(cmd, stdout, stderr), env...)
+// SetTransferConcurrency limit the number of files transferred concurrently,
+// independent of the max session of commands. Each file transfer takes a token
+// before opening file handles, so parallel transfers such as GetGlob never exceed
+// the limit of the server. Instances cloned afterwards share the same limit, it's
+// also the parallelism of GetGlob. Zero or negative n remove the limit and
+// GetGlob runs sequentially.
+func (s *SSH) SetTransferConcurrency(n int) {
+	if n <= 0 {
+		s.transfers = nil
+		return
+	}
+	s.transfers = make(chan struct{}, n)
 }
 
-func (s *SSH) LcmdBg(cmd, stdout, stderr string, env ...string) {
-	s.Lcmd(s.cmdStrBg(cmd, stdout, stderr), env...)
+func (s *SSH) acquireTransfer(ctx context.Context) error {
+	if s.transfers == nil {
+		return ctx.Err()
+	}
+	select {
+	case s.transfers <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (s *SSH) LwriteFile(path string, data []byte) {
-	s.withErrorCheck(func() error {
-		return s.writeFile(s.lfs, s.lpath(path), data)
-	})
+func (s *SSH) releaseTransfer() {
+	if s.transfers != nil {
+		<-s.transfers
+	}
 }
 
-func (s *SSH) RwriteFile(path string, data []byte) {
-	s.withErrorCheck(func() error {
-		return s.writeFile(s.rfs, s.rpath(path), data)
-	})
+// SetDefaultDirMode set the mode of directories created automatically for
+// destination files of transfers, the default is 0755. The mode is still
+// subject to umask of the host.
+func (s *SSH) SetDefaultDirMode(mode os.FileMode) {
+	s.dirMode = mode & os.ModePerm
 }
 
-func (s *SSH) LreadFile(path string) []byte {
-	var (
-		data []byte
-		err  error
-	)
-	s.withErrorCheck(func() error {
-		data, err = s.readFile(s.lfs, s.lpath(path))
-		return err
-	})
-	return data
+func (s *SSH) defaultDirMode() os.FileMode {
+	if s.dirMode == 0 {
+		return 0755
+	}
+	return s.dirMode
 }
 
-func (s *SSH) RreadFile(path string) []byte {
-	var (
-		data []byte
-		err  error
-	)
-	s.withErrorCheck(func() error {
-		data, err = s.readFile(s.rfs, s.rpath(path))
-		return err
-	})
-	return data
+// SetMaxDepth limit the depth of recursive operations such as Put, Get, Diff
+// and recursive remove, they fail with ErrMaxDepthExceeded for deeper trees.
+// DefaultMaxDepth is used if depth is not positive.
+func (s *SSH) SetMaxDepth(depth int) {
+	s.maxDepth = depth
 }
 
-func (s *SSH) Lreaddir(path string, n int) []os.FileInfo {
-	var (
-		items []os.FileInfo
-		err   error
-	)
-	s.withErrorCheck(func() error {
-		items, err = s.readdir(s.lfs, s.lpath(path), n)
-		return err
-	})
-	return items
+// SetFsRetry retry idempotent remote fs operations such as Stat, Mkdir and Open
+// for read on transient errors reported by the sftp server, attempts less than 2
+// disable it. A broken connection is not retried, use Reconnect for it.
+func (s *SSH) SetFsRetry(attempts int, backoff time.Duration) {
+	s.rfs = newRetryFs(s.rfs, attempts, backoff)
 }
 
-func (s *SSH) Rreaddir(path string, n int) []os.FileInfo {
-	var (
-		items []os.FileInfo
-		err   error
-	)
-	s.withErrorCheck(func() error {
-		items, err = s.readdir(s.rfs, s.rpath(path), n)
-		return err
-	})
-	return items
+// SetRemoteFs replace the filesystem used by remote file operations, such as
+// FsMem for testing. The working directory is kept, use Rcd to change it.
+func (s *SSH) SetRemoteFs(fs Fs) {
+	s.rfs = fs
 }
 
-func (s *SSH) Put(path, remotePath string) {
-	s.withErrorCheck(func() error {
-		return s.sync(s.lfs, s.rfs, s.lpath(path), s.rpath(remotePath))
-	})
+// SetLocalFs do the same thing as SetRemoteFs but for local host
+func (s *SSH) SetLocalFs(fs Fs) {
+	s.lfs = fs
 }
 
-func (s *SSH) Get(remotePath, path string) {
-	s.withErrorCheck(func() error {
-		return s.sync(s.rfs, s.lfs, s.rpath(remotePath), s.lpath(path))
+func (s *SSH) Lfs() Fs {
+	return newWdFs(s.cwd, s.lfs)
+}
+
+func (s *SSH) Rfs() Fs {
+	return newWdFs(s.rwd, s.rfs)
+}
+
+func (s *SSH) Rcmd(cmd string, env ...string) {
+	s.withReconnect(func() error {
+		return s.runRcmd(context.Background(), cmd, env...)
 	})
 }
 
-func (s *SSH) Rremove(path string, recursive bool) {
-	s.withErrorCheck(func() error {
-		return s.remove(s.rfs, s.rpath(path), recursive)
+// RcmdContext do the same thing as Rcmd but kill the command once the context
+// is canceled, the error is the context error in that case.
+func (s *SSH) RcmdContext(ctx context.Context, cmd string, env ...string) {
+	s.withReconnect(func() error {
+		return s.runRcmd(ctx, cmd, env...)
 	})
 }
 
-func (s *SSH) Lremove(path string, recursive bool) {
+// LcmdContext do the same thing as RcmdContext but for local host
+func (s *SSH) LcmdContext(ctx context.Context, cmd string, env ...string) {
 	s.withErrorCheck(func() error {
-		return s.remove(s.lfs, s.lpath(path), recursive)
+		return s.runLcmd(ctx, cmd, env...)
 	})
 }
 
-func (s *SSH) Rexists(path string) bool {
-	var (
-		exists bool
-		err    error
-	)
+// WithSession create a session limited by the session pool and call fn with it,
+// the session is closed and released after fn returned. It's useful for custom
+// session setup such as subsystems and pty. The connection isn't locked against
+// Reconnect while fn is running, the session just fails once reconnected.
+func (s *SSH) WithSession(fn func(sess *ssh.Session) error) error {
+	s.conn.mu.RLock()
+	sess, release, err := s.openSession()
+	s.conn.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return fn(sess)
+}
+
+// RcmdToFile run the command and write its stdout and stderr to local file
+// directly instead of buffering, configured pipes are not used.
+func (s *SSH) RcmdToFile(cmd, localPath string, env ...string) {
+	s.withReconnect(func() error {
+		path, err := s.lsafePath(localPath)
+		if err != nil {
+			return err
+		}
+		fd, err := s.openFile(s.lfs, path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+
+		err = s.withSession(func(sess *ssh.Session) error {
+			sess.Stdout, sess.Stderr = syncWriters(fd, fd)
+			return sess.Run(s.rcmdStr(cmd, strings.Join(env, " ")))
+		})
+
+		if cerr := fd.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	})
+}
+
+// RcmdIn run the command in the given directory, relative directory is based
+// on current remote working directory. The directory is always applied even if
+// auto cd is disabled.
+func (s *SSH) RcmdIn(dir, cmd string, env ...string) {
+	s.withReconnect(func() error {
+		return s.runRcmdRaw(context.Background(), s.cmdStr(s.rpath(dir), envStr(s.renv, strings.Join(env, " ")), s.wrapRcmd(cmd)))
+	})
+}
+
+// LcmdIn do the same thing as RcmdIn but for local host
+func (s *SSH) LcmdIn(dir, cmd string, env ...string) {
+	s.withErrorCheck(func() error {
+		return s.runLcmdStr(context.Background(), s.cmdStr(s.lpath(dir), envStr(s.lenv, strings.Join(env, " ")), cmd), env...)
+	})
+}
+
+// RcmdStdin run the command with stdin read from the data, the stdin set by
+// RemotePipeInput is not changed and not used for this command.
+func (s *SSH) RcmdStdin(cmd string, stdin []byte, env ...string) {
+	s.withReconnect(func() error {
+		cmd := s.rcmdStr(cmd, strings.Join(env, " "))
+		return s.runRcmdInput(context.Background(), cmd, bytes.NewReader(stdin))
+	})
+}
+
+// LcmdStdin do the same thing as RcmdStdin but for local host
+func (s *SSH) LcmdStdin(cmd string, stdin []byte, env ...string) {
+	s.withErrorCheck(func() error {
+		cmd := s.lcmdStr(cmd, strings.Join(env, " "))
+		return s.runLcmdInput(context.Background(), cmd, bytes.NewReader(stdin), env)
+	})
+}
+
+// RcmdCombined run the command and return its combined stdout and stderr like
+// exec.Cmd.CombinedOutput, configured pipes are ignored and the error and output
+// state of instance are not changed.
+func (s *SSH) RcmdCombined(cmd string, env ...string) ([]byte, error) {
+	cmd = s.rcmdStr(cmd, strings.Join(env, " "))
+	var out []byte
+	err := s.WithSession(func(sess *ssh.Session) error {
+		var err error
+		out, err = sess.CombinedOutput(cmd)
+		return err
+	})
+	return out, err
+}
+
+// LcmdCombined do the same thing as RcmdCombined but for local host
+func (s *SSH) LcmdCombined(cmd string, env ...string) ([]byte, error) {
+	c := exec.Command("sh", "-c", s.lcmdStr(cmd, strings.Join(env, " ")))
+	if len(env) > 0 {
+		c.Env = append(os.Environ(), env...)
+	}
+	return c.CombinedOutput()
+}
+
+// RcmdExpectExit run the command and return an error containing the combined
+// output if its exit code isn't wantCode, such as 1 for "grep -q" expecting no
+// match. Errors other than exit are returned as is, the state of instance is not
+// changed.
+func (s *SSH) RcmdExpectExit(cmd string, wantCode int, env ...string) error {
+	out, err := s.RcmdCombined(cmd, env...)
+	return checkExitCode(out, err, wantCode)
+}
+
+// LcmdExpectExit do the same thing as RcmdExpectExit but for local host
+func (s *SSH) LcmdExpectExit(cmd string, wantCode int, env ...string) error {
+	out, err := s.LcmdCombined(cmd, env...)
+	return checkExitCode(out, err, wantCode)
+}
+
+func checkExitCode(out []byte, err error, wantCode int) error {
+	code := exitCode(err)
+	if code < 0 {
+		return err
+	}
+	if code != wantCode {
+		return fmt.Errorf("%w: got %d, want %d, output: %s", ErrUnexpectedExitCode, code, wantCode, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// RcmdPipe run the command with output piped to the writers live, and return
+// the exit code and error, the exit code is -1 if it's not exited normally.
+// Configured pipes and the state of instance are not changed.
+func (s *SSH) RcmdPipe(cmd string, stdout, stderr io.Writer, env ...string) (int, error) {
+	cmd = s.rcmdStr(cmd, strings.Join(env, " "))
+	err := s.WithSession(func(sess *ssh.Session) error {
+		sess.Stdout, sess.Stderr = syncWriters(stdout, stderr)
+		return sess.Run(cmd)
+	})
+	return exitCode(err), err
+}
+
+// LcmdPipe do the same thing as RcmdPipe but for local host
+func (s *SSH) LcmdPipe(cmd string, stdout, stderr io.Writer, env ...string) (int, error) {
+	c := exec.Command("sh", "-c", s.lcmdStr(cmd, strings.Join(env, " ")))
+	if len(env) > 0 {
+		c.Env = append(os.Environ(), env...)
+	}
+	c.Stdout, c.Stderr = stdout, stderr
+	err := c.Run()
+	return exitCode(err), err
+}
+
+// syncWriters guard the writer with lock if it's used for both stdout and
+// stderr, ssh session copies them concurrently.
+func syncWriters(stdout, stderr io.Writer) (io.Writer, io.Writer) {
+	if stdout == nil || stdout != stderr {
+		return stdout, stderr
+	}
+	w := &lockedWriter{w: stdout}
+	return w, w
+}
+
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// RcmdRaw run the command exactly as given, the remote working directory and
+// env aren't applied, it's run from the login directory of remote host.
+func (s *SSH) RcmdRaw(cmd string) {
+	s.withReconnect(func() error {
+		return s.runRcmdRaw(context.Background(), cmd)
+	})
+}
+
+func (s *SSH) Lcmd(cmd string, env ...string) {
+	s.withErrorCheck(func() error {
+		return s.runLcmd(context.Background(), cmd, env...)
+	})
+}
+
+func (s *SSH) RcmdBg(cmd, stdout, stderr string, env ...string) {
+	s.Rcmd(s.rshell.cmdStrBg(cmd, stdout, stderr), env...)
+}
+
+func (s *SSH) LcmdBg(cmd, stdout, stderr string, env ...string) {
+	s.Lcmd(s.lshell.cmdStrBg(cmd, stdout, stderr), env...)
+}
+
+// RcmdEnvFile run the command after sourcing the remote env file, all variables
+// defined in it are exported to the command.
+func (s *SSH) RcmdEnvFile(cmd, envFile string, env ...string) {
+	s.Rcmd(s.cmdStrEnvFile(cmd, s.rpath(envFile)), env...)
+}
+
+// LcmdEnvFile do the same thing as RcmdEnvFile but for local host
+func (s *SSH) LcmdEnvFile(cmd, envFile string, env ...string) {
+	s.Lcmd(s.cmdStrEnvFile(cmd, s.lpath(envFile)), env...)
+}
+
+func (s *SSH) LwriteFile(path string, data []byte) {
+	s.withErrorCheck(func() error {
+		path, err := s.lsafePath(path)
+		if err != nil {
+			return err
+		}
+		return s.writeFile(s.lfs, path, data)
+	})
+}
+
+func (s *SSH) RwriteFile(path string, data []byte) {
+	s.withErrorCheck(func() error {
+		path, err := s.rsafePath(path)
+		if err != nil {
+			return err
+		}
+		return s.writeFile(s.rfs, path, data)
+	})
+}
+
+func (s *SSH) LreadFile(path string) []byte {
+	var data []byte
+	s.withErrorCheck(func() error {
+		path, err := s.lsafePath(path)
+		if err != nil {
+			return err
+		}
+		data, err = s.readFile(s.lfs, path)
+		return err
+	})
+	return data
+}
+
+// Ropen open the remote file for random access, relative path is based on the
+// remote working directory. The caller should close the file.
+func (s *SSH) Ropen(path string, flag int, perm os.FileMode) (File, error) {
+	path, err := s.rsafePath(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.openFile(s.rfs, path, flag, perm)
+}
+
+// Lopen do the same thing as Ropen but for local host
+func (s *SSH) Lopen(path string, flag int, perm os.FileMode) (File, error) {
+	path, err := s.lsafePath(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.openFile(s.lfs, path, flag, perm)
+}
+
+func (s *SSH) RreadFile(path string) []byte {
+	var data []byte
+	s.withErrorCheck(func() error {
+		path, err := s.rsafePath(path)
+		if err != nil {
+			return err
+		}
+		data, err = s.readFile(s.rfs, path)
+		return err
+	})
+	return data
+}
+
+// LreadFileN read at most n bytes from the beginning of local file
+func (s *SSH) LreadFileN(path string, n int) []byte {
+	var data []byte
+	s.withErrorCheck(func() error {
+		path, err := s.lsafePath(path)
+		if err != nil {
+			return err
+		}
+		data, err = s.readFileN(s.lfs, path, n)
+		return err
+	})
+	return data
+}
+
+// RreadFileN read at most n bytes from the beginning of remote file,
+// ErrInvalidRange is returned if n is negative.
+func (s *SSH) RreadFileN(path string, n int) []byte {
+	var data []byte
+	s.withErrorCheck(func() error {
+		path, err := s.rsafePath(path)
+		if err != nil {
+			return err
+		}
+		data, err = s.readFileN(s.rfs, path, n)
+		return err
+	})
+	return data
+}
+
+// RreadFileGz read the gzip compressed remote file and return the decompressed
+// content, ErrNotGzip is returned if the file isn't gzip format.
+func (s *SSH) RreadFileGz(path string) []byte {
+	var data []byte
+	s.withErrorCheck(func() error {
+		path, err := s.rsafePath(path)
+		if err != nil {
+			return err
+		}
+		data, err = s.readFileGz(s.rfs, path)
+		return err
+	})
+	return data
+}
+
+// LreadFileGz do the same thing as RreadFileGz but for local host
+func (s *SSH) LreadFileGz(path string) []byte {
+	var data []byte
+	s.withErrorCheck(func() error {
+		path, err := s.lsafePath(path)
+		if err != nil {
+			return err
+		}
+		data, err = s.readFileGz(s.lfs, path)
+		return err
+	})
+	return data
+}
+
+func (s *SSH) Lreaddir(path string, n int) []os.FileInfo {
+	var items []os.FileInfo
+	s.withErrorCheck(func() error {
+		path, err := s.lsafePath(path)
+		if err != nil {
+			return err
+		}
+		items, err = s.readdir(s.lfs, path, n)
+		return err
+	})
+	return items
+}
+
+func (s *SSH) Rreaddir(path string, n int) []os.FileInfo {
+	var items []os.FileInfo
+	s.withErrorCheck(func() error {
+		path, err := s.rsafePath(path)
+		if err != nil {
+			return err
+		}
+		items, err = s.readdir(s.rfs, path, n)
+		return err
+	})
+	return items
+}
+
+// LreaddirFilter do the same thing as RreaddirFilter but for local host
+func (s *SSH) LreaddirFilter(path string, keep func(os.FileInfo) bool) []os.FileInfo {
+	var items []os.FileInfo
+	s.withErrorCheck(func() error {
+		path, err := s.lsafePath(path)
+		if err != nil {
+			return err
+		}
+		items, err = s.readdirFilter(s.lfs, path, keep)
+		return err
+	})
+	return items
+}
+
+// RreaddirFilter return all entries of remote directory that keep returns true,
+// sorted by name.
+func (s *SSH) RreaddirFilter(path string, keep func(os.FileInfo) bool) []os.FileInfo {
+	var items []os.FileInfo
+	s.withErrorCheck(func() error {
+		path, err := s.rsafePath(path)
+		if err != nil {
+			return err
+		}
+		items, err = s.readdirFilter(s.rfs, path, keep)
+		return err
+	})
+	return items
+}
+
+func (s *SSH) Put(path, remotePath string) {
+	s.PutContext(context.Background(), path, remotePath)
+}
+
+func (s *SSH) Get(remotePath, path string) {
+	s.GetContext(context.Background(), remotePath, path)
+}
+
+// PutContext do the same thing as Put but stop once the context is canceled,
+// the partial destination file will be removed.
+func (s *SSH) PutContext(ctx context.Context, path, remotePath string) {
+	s.withErrorCheck(func() error {
+		path, remotePath, err := s.transferPaths(path, remotePath)
+		if err != nil {
+			return err
+		}
+		return s.transfer(ctx, &syncOptions{}, s.lfs, s.rfs, path, remotePath)
+	})
+}
+
+// GetContext do the same thing as PutContext but for Get
+func (s *SSH) GetContext(ctx context.Context, remotePath, path string) {
+	s.withErrorCheck(func() error {
+		path, remotePath, err := s.transferPaths(path, remotePath)
+		if err != nil {
+			return err
+		}
+		return s.transfer(ctx, &syncOptions{}, s.rfs, s.lfs, remotePath, path)
+	})
+}
+
+// PutContinueOnError do the same thing as Put but doesn't stop at failed files,
+// the error will be SyncErrors contains all of them.
+func (s *SSH) PutContinueOnError(path, remotePath string) {
+	s.withErrorCheck(func() error {
+		path, remotePath, err := s.transferPaths(path, remotePath)
+		if err != nil {
+			return err
+		}
+		opts := syncOptions{continueOnError: true}
+		return s.transfer(context.Background(), &opts, s.lfs, s.rfs, path, remotePath)
+	})
+}
+
+// Rglob return remote paths matching the pattern, the syntax is the same as
+// filepath.Match.
+func (s *SSH) Rglob(pattern string) []string {
+	var matches []string
+	s.withErrorCheck(func() error {
+		pattern, err := s.rsafePath(pattern)
+		if err != nil {
+			return err
+		}
+		matches, err = fsGlob(s.rfs, pattern)
+		return err
+	})
+	return matches
+}
+
+// Lglob do the same thing as Rglob but for local host
+func (s *SSH) Lglob(pattern string) []string {
+	var matches []string
+	s.withErrorCheck(func() error {
+		pattern, err := s.lsafePath(pattern)
+		if err != nil {
+			return err
+		}
+		matches, err = fsGlob(s.lfs, pattern)
+		return err
+	})
+	return matches
+}
+
+// GetGlob download all remote files matching the pattern into local directory,
+// base names are preserved. Directories are rejected unless recursive is true.
+// Files are downloaded in parallel if SetTransferConcurrency is set, the first
+// error aborts the remaining ones.
+func (s *SSH) GetGlob(remotePattern, localDir string, recursive bool) {
+	matches := s.Rglob(remotePattern)
+	s.withErrorCheck(func() error {
+		dir, err := s.lsafePath(localDir)
+		if err != nil {
+			return err
+		}
+		if !recursive {
+			for _, match := range matches {
+				stat, err := s.rfs.Stat(match)
+				if err != nil {
+					return err
+				}
+				if stat.IsDir() {
+					return fmt.Errorf("%s: %w", match, ErrIsDir)
+				}
+			}
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var (
+			lfpath, rfpath = s.lfs.Filepath(), s.rfs.Filepath()
+			jobs           = make(chan string)
+			wg             sync.WaitGroup
+			errOnce        sync.Once
+			firstErr       error
+		)
+		workers := cap(s.transfers)
+		if workers <= 0 {
+			workers = 1
+		}
+		for i := 0; i < workers && i < len(matches); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for match := range jobs {
+					err := s.transfer(ctx, &syncOptions{}, s.rfs, s.lfs, match, lfpath.Join(dir, rfpath.Base(match)))
+					if err != nil && ctx.Err() == nil {
+						errOnce.Do(func() {
+							firstErr = err
+							cancel()
+						})
+					}
+				}
+			}()
+		}
+	send:
+		for _, match := range matches {
+			select {
+			case jobs <- match:
+			case <-ctx.Done():
+				break send
+			}
+		}
+		close(jobs)
+		wg.Wait()
+		return firstErr
+	})
+}
+
+// PutWithModes do the same thing as Put but override modes of files listed in
+// modes, the keys are slash-separated paths relative to path. Unlisted files keep
+// their source mode.
+func (s *SSH) PutWithModes(path, remotePath string, modes map[string]os.FileMode) {
+	s.withErrorCheck(func() error {
+		path, remotePath, err := s.transferPaths(path, remotePath)
+		if err != nil {
+			return err
+		}
+		return s.transfer(context.Background(), &syncOptions{modes: modes}, s.lfs, s.rfs, path, remotePath)
+	})
+}
+
+// PutExclude do the same thing as Put but skip files and directories matching
+// any of the glob patterns, it's the same as PutFilter with only Exclude.
+func (s *SSH) PutExclude(path, remotePath string, excludes []string) {
+	s.PutFilter(path, remotePath, &SyncFilter{Exclude: excludes})
+}
+
+// PutFilter do the same thing as Put but only upload entries accepted by the
+// filter, see SyncFilter for the rules.
+func (s *SSH) PutFilter(path, remotePath string, filter *SyncFilter) {
+	s.withErrorCheck(func() error {
+		err := filter.validate()
+		if err != nil {
+			return err
+		}
+		path, remotePath, err := s.transferPaths(path, remotePath)
+		if err != nil {
+			return err
+		}
+		return s.transfer(context.Background(), &syncOptions{filter: filter}, s.lfs, s.rfs, path, remotePath)
+	})
+}
+
+// GetFilter do the same thing as PutFilter but for download
+func (s *SSH) GetFilter(remotePath, path string, filter *SyncFilter) {
+	s.withErrorCheck(func() error {
+		err := filter.validate()
+		if err != nil {
+			return err
+		}
+		path, remotePath, err := s.transferPaths(path, remotePath)
+		if err != nil {
+			return err
+		}
+		return s.transfer(context.Background(), &syncOptions{filter: filter}, s.rfs, s.lfs, remotePath, path)
+	})
+}
+
+// PutSparse do the same thing as Put but keep holes of sparse files such as disk
+// images, zero blocks are skipped by seeking instead of being written. Whether
+// the destination is really sparse depends on the remote filesystem.
+func (s *SSH) PutSparse(path, remotePath string) {
+	s.withErrorCheck(func() error {
+		path, remotePath, err := s.transferPaths(path, remotePath)
+		if err != nil {
+			return err
+		}
+		return s.transfer(context.Background(), &syncOptions{sparse: true}, s.lfs, s.rfs, path, remotePath)
+	})
+}
+
+func (s *SSH) Rremove(path string, recursive bool) {
+	s.withErrorCheck(func() error {
+		path, err := s.rsafePath(path)
+		if err != nil {
+			return err
+		}
+		return s.remove(s.rfs, path, recursive)
+	})
+}
+
+func (s *SSH) Lremove(path string, recursive bool) {
+	s.withErrorCheck(func() error {
+		path, err := s.lsafePath(path)
+		if err != nil {
+			return err
+		}
+		return s.remove(s.lfs, path, recursive)
+	})
+}
+
+// RreaddirEach call fn for each entry of remote directory in the order of
+// directory, entries are read in batch and not sorted. It stop at the first
+// error returned by fn.
+func (s *SSH) RreaddirEach(path string, fn func(os.FileInfo) error) {
+	s.withErrorCheck(func() error {
+		path, err := s.rsafePath(path)
+		if err != nil {
+			return err
+		}
+		return s.readdirEach(s.rfs, path, fn)
+	})
+}
+
+// LreaddirEach do the same thing as RreaddirEach but for local host
+func (s *SSH) LreaddirEach(path string, fn func(os.FileInfo) error) {
+	s.withErrorCheck(func() error {
+		path, err := s.lsafePath(path)
+		if err != nil {
+			return err
+		}
+		return s.readdirEach(s.lfs, path, fn)
+	})
+}
+
+// RchtimesFrom set the access and modify time of remote file to the ones of
+// remote reference file.
+func (s *SSH) RchtimesFrom(path, refPath string) {
+	s.withErrorCheck(func() error {
+		path, err := s.rsafePath(path)
+		if err != nil {
+			return err
+		}
+		refPath, err = s.rsafePath(refPath)
+		if err != nil {
+			return err
+		}
+		return s.chtimesFrom(s.rfs, path, refPath)
+	})
+}
+
+// LchtimesFrom do the same thing as RchtimesFrom but for local host, the access
+// time is set to the modify time of reference file since it's not portable.
+func (s *SSH) LchtimesFrom(path, refPath string) {
+	s.withErrorCheck(func() error {
+		path, err := s.lsafePath(path)
+		if err != nil {
+			return err
+		}
+		refPath, err = s.lsafePath(refPath)
+		if err != nil {
+			return err
+		}
+		return s.chtimesFrom(s.lfs, path, refPath)
+	})
+}
+
+// Rtouch create the remote file if it doesn't exist and update its times to now
+func (s *SSH) Rtouch(path string) {
+	s.withErrorCheck(func() error {
+		path, err := s.rsafePath(path)
+		if err != nil {
+			return err
+		}
+		return s.touch(s.rfs, path)
+	})
+}
+
+// Ltouch do the same thing as Rtouch but for local host
+func (s *SSH) Ltouch(path string) {
+	s.withErrorCheck(func() error {
+		path, err := s.lsafePath(path)
+		if err != nil {
+			return err
+		}
+		return s.touch(s.lfs, path)
+	})
+}
+
+// Rexists check whether the remote path exists, it fallback to "test -e" if
+// sftp is unavailable for the connection.
+func (s *SSH) Rexists(path string) bool {
+	var exists bool
 	s.withErrorCheck(func() error {
-		exists, err = s.exists(s.rfs, s.rpath(path))
+		path, err := s.rsafePath(path)
+		if err != nil {
+			return err
+		}
+		exists, err = s.rexists(path)
 		return err
 	})
 	return exists
 }
 
 func (s *SSH) Lexists(path string) bool {
-	var (
-		exists bool
-		err    error
-	)
+	var exists bool
 	s.withErrorCheck(func() error {
-		exists, err = s.exists(s.lfs, s.lpath(path))
+		path, err := s.lsafePath(path)
+		if err != nil {
+			return err
+		}
+		exists, err = s.exists(s.lfs, path)
 		return err
 	})
 	return exists
 }
 
+// defaultWaitPoll is the poll interval of RwaitFile if the given one isn't
+// positive.
+const defaultWaitPoll = 500 * time.Millisecond
+
+// RwaitFile poll until the remote file exists, ErrWaitTimeout is returned if
+// timeout elapsed. Non-positive poll is replaced by 500ms.
+func (s *SSH) RwaitFile(path string, timeout, poll time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.RwaitFileContext(ctx, path, poll)
+}
+
+// RwaitFileContext do the same thing as RwaitFile but stop once the context is
+// done, ErrWaitTimeout is returned if context deadline exceeded.
+func (s *SSH) RwaitFileContext(ctx context.Context, path string, poll time.Duration) error {
+	path, err := s.rsafePath(path)
+	if err != nil {
+		return err
+	}
+
+	if poll <= 0 {
+		poll = defaultWaitPoll
+	}
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		var exists bool
+		err := s.guarded(func() error {
+			var err error
+			exists, err = s.rexists(path)
+			return err
+		})
+		if err != nil || exists {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return ErrWaitTimeout
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
 // Rcwd return current remote working directory
 func (s *SSH) Rcwd() string {
 	return s.rwd
@@ -388,6 +1613,43 @@ func (s *SSH) Rcd(cwd string) {
 	s.rwd = s.rpath(cwd)
 }
 
+// RcdChecked do the same thing as Rcd but return an error and keep current
+// directory unchanged if the destination is not an existing directory.
+func (s *SSH) RcdChecked(cwd string) error {
+	path := s.rpath(cwd)
+	var stat os.FileInfo
+	err := s.guarded(func() error {
+		var err error
+		stat, err = s.rfs.Stat(path)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return ErrNotDir
+	}
+	s.rwd = path
+	return nil
+}
+
+// ResolveCwd replace both remote and local working directories with the result
+// of EvalSymlinks, so that relative paths of file operations resolve the same
+// as the cd of commands when working directories are symbolic links, such as
+// "current -> releases/5". Both are kept unchanged if an error occurred.
+func (s *SSH) ResolveCwd() error {
+	rwd, err := EvalSymlinks(s.rfs, s.rwd)
+	if err != nil {
+		return err
+	}
+	cwd, err := EvalSymlinks(s.lfs, s.cwd)
+	if err != nil {
+		return err
+	}
+	s.rwd, s.cwd = rwd, cwd
+	return nil
+}
+
 // TmpRcd will create an copy of current instance but doesn't change reference count,
 // then call Rcd on it. It should only used for temporary change directory and be
 // quickly destroyed.
@@ -397,6 +1659,16 @@ func (s *SSH) TmpRcd(cwd string) *SSH {
 	return &ns
 }
 
+// RexpandHome replace the leading ~ of path with remote home directory
+func (s *SSH) RexpandHome(path string) string {
+	return expandHome(s.rfs, s.rhome, path)
+}
+
+// LexpandHome do the same thing as RexpandHome but for local host
+func (s *SSH) LexpandHome(path string) string {
+	return expandHome(s.lfs, s.lhome, path)
+}
+
 // Lcwd return current local working directory
 func (s *SSH) Lcwd() string {
 	return s.cwd
@@ -417,30 +1689,88 @@ func (s *SSH) TmpLcd(cwd string) *SSH {
 // private
 
 func (s *SSH) rcmdStr(cmd, env string) string {
-	return s.cmdStr(s.rwd, env, cmd)
+	return s.cmdStr(s.autoCdDir(s.rwd), envStr(s.renv, env), s.wrapRcmd(cmd))
+}
+
+func (s *SSH) wrapRcmd(cmd string) string {
+	if s.rwrap == nil {
+		return cmd
+	}
+	return s.rwrap(cmd)
 }
 
 func (s *SSH) lcmdStr(cmd, env string) string {
-	return s.cmdStr(s.cwd, env, cmd)
+	return s.cmdStr(s.autoCdDir(s.cwd), envStr(s.lenv, env), cmd)
+}
+
+// envStr prepend persistent env to env, so the per-call ones win
+func envStr(persistent map[string]string, env string) string {
+	if len(persistent) == 0 {
+		return env
+	}
+	keys := make([]string, 0, len(persistent))
+	for k := range persistent {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	envs := make([]string, 0, len(keys)+1)
+	for _, k := range keys {
+		envs = append(envs, k+"="+shellQuote(persistent[k]))
+	}
+	if env != "" {
+		envs = append(envs, env)
+	}
+	return strings.Join(envs, " ")
+}
+
+func (s *SSH) autoCdDir(wd string) string {
+	if s.noAutoCd {
+		return ""
+	}
+	return wd
 }
 
 func (s *SSH) cmdStr(cwd, env, cmd string) string {
 	if env != "" {
-		env = "export " + env + " " + CmdSeperator
+		env = "export " + env + " " + s.cmdSeparator()
 	}
 	if cwd != "" {
-		cwd = "cd " + cwd + " " + CmdSeperator
+		cwd = "cd " + cwd + " " + s.cmdSeparator()
 	}
 	return cwd + " " + env + " " + cmd
 }
 
 func (s *SSH) remove(fs Fs, path string, recursive bool) error {
 	if recursive {
-		return fs.RemoveAll(path)
+		return s.removeAll(fs, path, s.depthLimit())
 	}
 	return fs.Remove(path)
 }
 
+// removeAll do the same thing as Fs.RemoveAll but limit the depth, nothing is
+// removed if the tree is too deep.
+func (s *SSH) removeAll(fs Fs, path string, depth int) error {
+	// check the depth before removing anything
+	err := WalkDepth(fs, path, depth, func(path string, info os.FileInfo, err error) error {
+		if err != nil && fs.IsNotExist(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return fs.RemoveAll(path)
+}
+
+func (s *SSH) depthLimit() int {
+	if s.maxDepth > 0 {
+		return s.maxDepth
+	}
+	return DefaultMaxDepth
+}
+
 func (s *SSH) checkIsDir(fd File, stat os.FileInfo, err error) (File, error) {
 	if err != nil {
 		err = nil
@@ -456,46 +1786,131 @@ func (s *SSH) openFile(fs Fs, path string, flag int, mode os.FileMode) (File, er
 	if err != nil {
 		return nil, err
 	}
-	stat, err := fd.Stat()
-	return s.checkIsDir(fd, stat, err)
+	stat, err := fd.Stat()
+	return s.checkIsDir(fd, stat, err)
+}
+
+// runCmd run the command with configured pipes, in overrides the configured
+// stdin if it's not nil.
+func (s *SSH) runCmd(isRemote bool, in io.Reader, stdin *io.Reader, stdout, stderr *io.Writer, run func() error) error {
+	var ow, ew io.Writer
+	if isRemote {
+		if in == nil {
+			in = s.rIn
+		}
+		ow, ew = s.rOut, s.rErr
+	} else {
+		if in == nil {
+			in = s.lIn
+		}
+		ow, ew = s.lOut, s.lErr
+	}
+	*stdin = in
+	if ow == nil && ew == nil {
+		// ssh session copies stdout and stderr concurrently
+		var b lockedBuffer
+		*stdout = &b
+		*stderr = &b
+		err := run()
+		s.lastOutput = b.Bytes()
+		return err
+	}
+
+	// keep the tail of output for diagnostics once the command failed
+	tail := lockedBuffer{limit: pipeOutputTailSize}
+	*stdout = teeWriter(ow, &tail)
+	if ew == ow {
+		*stderr = *stdout
+	} else {
+		*stderr = teeWriter(ew, &tail)
+	}
+	err := run()
+	s.lastOutput = nil
+	if err != nil {
+		s.lastOutput = tail.Bytes()
+	}
+	return err
+}
+
+// pipeOutputTailSize is the max size of output kept for failed commands whose
+// output are piped.
+const pipeOutputTailSize = 64 * 1024
+
+func teeWriter(w io.Writer, tail io.Writer) io.Writer {
+	if w == nil {
+		return tail
+	}
+	return io.MultiWriter(w, tail)
+}
+
+func (s *SSH) runRcmd(ctx context.Context, cmd string, env ...string) error {
+	return s.runRcmdRaw(ctx, s.rcmdStr(cmd, strings.Join(env, " ")))
+}
+
+func (s *SSH) runRcmdRaw(ctx context.Context, cmd string) error {
+	return s.runRcmdInput(ctx, cmd, nil)
+}
+
+func (s *SSH) runRcmdInput(ctx context.Context, cmd string, in io.Reader) error {
+	return s.withSession(func(sess *ssh.Session) error {
+		return s.runCmd(true, in, &sess.Stdin, &sess.Stdout, &sess.Stderr, func() error {
+			if ctx.Done() == nil {
+				return sess.Run(cmd)
+			}
+			return runSessionContext(ctx, sess, cmd)
+		})
+	})
+}
+
+func runSessionContext(ctx context.Context, sess *ssh.Session, cmd string) error {
+	err := sess.Start(cmd)
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- sess.Wait()
+	}()
+
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		sess.Signal(ssh.SIGKILL)
+		sess.Close()
+		<-done
+		return ctx.Err()
+	}
 }
 
-func (s *SSH) runCmd(isRemote bool, stdin *io.Reader, stdout, stderr *io.Writer, run func() error) error {
-	var (
-		in     io.Reader
-		ow, ew io.Writer
-	)
-	if isRemote {
-		in = s.rIn
-		ow, ew = s.rOut, s.rErr
-	} else {
-		in = s.lIn
-		ow, ew = s.lOut, s.lErr
-	}
-	*stdin = in
-	if ow == nil && ew == nil {
-		var b bytes.Buffer
-		*stdout = &b
-		*stderr = &b
-		err := run()
-		s.lastOutput = b.Bytes()
+func (s *SSH) withSession(fn func(sess *ssh.Session) error) error {
+	sess, release, err := s.openSession()
+	if err != nil {
 		return err
 	}
-
-	*stdout = ow
-	*stderr = ew
-	s.lastOutput = nil
-	return run()
+	defer release()
+	return fn(sess)
 }
 
-func (s *SSH) runRcmd(cmd string, env ...string) error {
+// openSession create a session limited by the session pool, release must be
+// called to close the session and end the busy state.
+func (s *SSH) openSession() (sess *ssh.Session, release func(), err error) {
+	c := s.conn
+	if c.client == nil {
+		return nil, nil, ErrConnClosed
+	}
+	end, err := s.busy()
+	if err != nil {
+		return nil, nil, err
+	}
 	for {
-		session, ok := s.sessionPool.Take()
+		session, ok := c.sessionPool.Take()
 		if !ok {
-			return ErrConnClosed
+			end()
+			return nil, nil, ErrConnClosed
 		}
 
-		sess, err := s.conn.NewSession()
+		sess, err := c.client.NewSession()
 		if err != nil {
 			if chanErr, ok := err.(*ssh.OpenChannelError); ok {
 				if chanErr.Reason == ssh.Prohibited {
@@ -505,41 +1920,74 @@ func (s *SSH) runRcmd(cmd string, env ...string) error {
 			}
 
 			session.Release()
-			return err
+			end()
+			return nil, nil, err
 		}
 
-		defer func() {
+		return sess, func() {
 			sess.Close()
 			session.Release()
-		}()
-
-		cmd := s.rcmdStr(cmd, strings.Join(env, " "))
-		return s.runCmd(true, &sess.Stdin, &sess.Stdout, &sess.Stderr, func() error {
-			return sess.Run(cmd)
-		})
+			end()
+		}, nil
 	}
 }
 
-func (s *SSH) cmdStrBg(cmd, stdout, stderr string) string {
-	if stdout == "" {
-		stdout = "nohup.out"
-	}
-	if stderr == "" || stderr == stdout {
-		stderr = "&1"
-	}
-	return fmt.Sprintf("nohup %s >%s 2>%s </dev/null &", cmd, stdout, stderr)
+func (s *SSH) cmdStrEnvFile(cmd, envFile string) string {
+	sep := " " + s.cmdSeparator() + " "
+	return "set -a" + sep + ". " + envFile + sep + "set +a" + sep + cmd
 }
 
-func (s *SSH) runLcmd(cmd string, env ...string) error {
-	c := exec.Command("sh", "-c", s.lcmdStr(cmd, strings.Join(env, " ")))
+func (s *SSH) runLcmd(ctx context.Context, cmd string, env ...string) error {
+	return s.runLcmdStr(ctx, s.lcmdStr(cmd, strings.Join(env, " ")), env...)
+}
+
+func (s *SSH) runLcmdStr(ctx context.Context, cmd string, env ...string) error {
+	return s.runLcmdInput(ctx, cmd, nil, env)
+}
+
+func (s *SSH) runLcmdInput(ctx context.Context, cmd string, in io.Reader, env []string) error {
+	c := exec.CommandContext(ctx, "sh", "-c", cmd)
+	// children of the killed shell may still hold the output pipes
+	c.WaitDelay = time.Second
 	if len(env) > 0 {
-		c.Env = append(c.Env, env...)
+		c.Env = append(os.Environ(), env...)
 	}
-	return s.runCmd(false, &c.Stdin, &c.Stdout, &c.Stderr, func() error {
-		return c.Run()
+	return s.runCmd(false, in, &c.Stdin, &c.Stdout, &c.Stderr, func() error {
+		err := c.Run()
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
 	})
 }
 
+// lockedBuffer is a buffer safe for concurrent writing, only the last limit
+// bytes are kept if limit is positive.
+type lockedBuffer struct {
+	mu    sync.Mutex
+	buf   []byte
+	limit int
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = append(b.buf, p...)
+	if b.limit > 0 && len(b.buf) > 2*b.limit {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-b.limit:]...)
+	}
+	return len(p), nil
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit > 0 && len(b.buf) > b.limit {
+		return b.buf[len(b.buf)-b.limit:]
+	}
+	return b.buf
+}
+
 type byName []os.FileInfo
 
 func (f byName) Len() int           { return len(f) }
@@ -559,6 +2007,99 @@ func (s *SSH) readdir(fs Fs, path string, n int) ([]os.FileInfo, error) {
 	sort.Sort(byName(list))
 	return list, nil
 }
+
+func (s *SSH) readdirFilter(fs Fs, path string, keep func(os.FileInfo) bool) ([]os.FileInfo, error) {
+	list, err := s.readdir(fs, path, -1)
+	if err != nil {
+		return nil, err
+	}
+	kept := list[:0]
+	for _, item := range list {
+		if keep(item) {
+			kept = append(kept, item)
+		}
+	}
+	return kept, nil
+}
+
+func (s *SSH) touch(fs Fs, path string) error {
+	fd, err := fs.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	fd.Close()
+
+	now := time.Now()
+	return fs.Chtimes(path, now, now)
+}
+
+func (s *SSH) chtimesFrom(fs Fs, path, refPath string) error {
+	stat, err := fs.Stat(refPath)
+	if err != nil {
+		return err
+	}
+	return fs.Chtimes(path, fileAtime(stat), stat.ModTime())
+}
+
+// fileAtime return the access time from sftp stat, or the modify time if it's
+// unavailable.
+func fileAtime(info os.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*sftp.FileStat); ok {
+		return time.Unix(int64(stat.Atime), 0)
+	}
+	return info.ModTime()
+}
+
+func (s *SSH) readdirEach(fs Fs, path string, fn func(os.FileInfo) error) error {
+	const batchSize = 100
+
+	f, err := fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for {
+		list, err := f.Readdir(batchSize)
+		for _, fi := range list {
+			if err := fn(fi); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || (err == nil && len(list) == 0) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// rexists check the existence of remote path by sftp, or by command if sftp is
+// unavailable.
+func (s *SSH) rexists(path string) (bool, error) {
+	if isFsUnavailable(s.rfs) {
+		return s.rexistsCmd(path)
+	}
+	return s.exists(s.rfs, path)
+}
+
+// rexistsCmd check path existence by "test -e" for connections without sftp,
+// exit code 1 means not exist.
+func (s *SSH) rexistsCmd(path string) (bool, error) {
+	err := s.withSession(func(sess *ssh.Session) error {
+		return sess.Run("test -e " + shellQuote(path))
+	})
+	switch exitCode(err) {
+	case 0:
+		return true, nil
+	case 1:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
 func (s *SSH) exists(fs Fs, path string) (bool, error) {
 	_, err := fs.Stat(path)
 	if err != nil {
@@ -570,30 +2111,136 @@ func (s *SSH) exists(fs Fs, path string) (bool, error) {
 	return true, nil
 }
 
-func (s *SSH) sync(fs, remoteFs Fs, path, remotePath string) error {
-	fd, err := fs.Open(path)
-	if err != nil {
+// SyncError is the error of a single file during sync
+type SyncError struct {
+	Path string
+	Err  error
+}
+
+// SyncErrors is the aggregate error of all failed files during sync
+type SyncErrors []SyncError
+
+func (e SyncErrors) Error() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "sync failed for %d files", len(e))
+	for _, err := range e {
+		buf.WriteString("; " + err.Path + ": " + err.Err.Error())
+	}
+	return buf.String()
+}
+
+type syncOptions struct {
+	continueOnError bool
+	// modes override file modes, keyed by slash-separated path relative to root
+	modes map[string]os.FileMode
+
+	// sparse skip writing zero blocks to keep holes of files
+	sparse bool
+	// filter skip files and directories, nil for all
+	filter *SyncFilter
+
+	root string
+	errs SyncErrors
+}
+
+// relPath return the slash-separated path relative to root, it's the base name
+// for root itself.
+func (o *syncOptions) relPath(fs Fs, path string) (string, bool) {
+	fpath := fs.Filepath()
+	rel := fpath.Base(path)
+	if path != o.root {
+		var err error
+		rel, err = fpath.Rel(o.root, path)
+		if err != nil {
+			return "", false
+		}
+	}
+	return fpath.ToSlash(rel), true
+}
+
+// accept report whether path is accepted by the filter, the root is never
+// filtered.
+func (o *syncOptions) accept(fs Fs, path string, info os.FileInfo) bool {
+	if o.filter == nil || path == o.root {
+		return true
+	}
+	rel, ok := o.relPath(fs, path)
+	return !ok || o.filter.Accept(rel, info)
+}
+
+func (o *syncOptions) fileMode(fs Fs, path string, stat os.FileInfo) os.FileMode {
+	if len(o.modes) == 0 {
+		return stat.Mode()
+	}
+	rel, ok := o.relPath(fs, path)
+	if !ok {
+		return stat.Mode()
+	}
+	mode, has := o.modes[rel]
+	if !has {
+		return stat.Mode()
+	}
+	return stat.Mode()&^os.ModePerm | mode&os.ModePerm
+}
+
+// fail record the error and return nil if continue on error, canceled context
+// always abort the sync.
+func (o *syncOptions) fail(ctx context.Context, path string, err error) error {
+	if !o.continueOnError || ctx.Err() != nil {
 		return err
 	}
-	defer fd.Close()
+	o.errs = append(o.errs, SyncError{Path: path, Err: err})
+	return nil
+}
+
+func (s *SSH) transfer(ctx context.Context, opts *syncOptions, fs, remoteFs Fs, path, remotePath string) error {
+	opts.root = path
+	err := s.sync(ctx, opts, fs, remoteFs, path, remotePath, s.depthLimit())
+	if err == nil && len(opts.errs) > 0 {
+		err = opts.errs
+	}
+	return err
+}
 
+func (s *SSH) sync(ctx context.Context, opts *syncOptions, fs, remoteFs Fs, path, remotePath string, depth int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if depth < 0 {
+		return opts.fail(ctx, path, ErrMaxDepthExceeded)
+	}
 	info, err := fs.Stat(path)
 	if err != nil {
-		return err
+		return opts.fail(ctx, path, err)
+	}
+	if !opts.accept(fs, path, info) {
+		return nil
 	}
 	if !info.IsDir() {
-		return s.syncFile(remoteFs, remotePath, fd, info)
+		err = s.syncRegular(ctx, opts, fs, remoteFs, path, remotePath, info)
+		if err != nil {
+			return opts.fail(ctx, path, err)
+		}
+		return nil
 	}
 
-	dirnames, err := fd.Readdir(-1)
+	dirnames, err := s.readdirLimited(ctx, fs, path)
 	if err != nil {
-		return err
+		return opts.fail(ctx, path, err)
+	}
+	if len(dirnames) == 0 {
+		// nothing below triggers the creation of empty directory
+		err = s.syncDir(remoteFs, remotePath, opts.fileMode(fs, path, info).Perm())
+		if err != nil {
+			return opts.fail(ctx, path, err)
+		}
+		return nil
 	}
 
 	lfpath, rfpath := fs.Filepath(), remoteFs.Filepath()
 	for _, dirname := range dirnames {
 		name := dirname.Name()
-		err = s.sync(fs, remoteFs, lfpath.Join(path, name), rfpath.Join(remotePath, name))
+		err = s.sync(ctx, opts, fs, remoteFs, lfpath.Join(path, name), rfpath.Join(remotePath, name), depth-1)
 		if err != nil {
 			return err
 		}
@@ -601,7 +2248,49 @@ func (s *SSH) sync(fs, remoteFs Fs, path, remotePath string) error {
 	return nil
 }
 
-func (s *SSH) syncFile(rfs Fs, rpath string, fd io.Reader, stat os.FileInfo) error {
+// syncRegular copy a regular file, file handles are opened only after a
+// transfer token is taken.
+func (s *SSH) syncRegular(ctx context.Context, opts *syncOptions, fs, remoteFs Fs, path, remotePath string, info os.FileInfo) error {
+	err := s.acquireTransfer(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.releaseTransfer()
+
+	fd, err := fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return s.syncFile(ctx, remoteFs, remotePath, fd, info, opts.fileMode(fs, path, info), opts.sparse)
+}
+
+// readdirLimited read the directory entries with a transfer token, the handle
+// is closed before returning so it's not held during recursion.
+func (s *SSH) readdirLimited(ctx context.Context, fs Fs, path string) ([]os.FileInfo, error) {
+	err := s.acquireTransfer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.releaseTransfer()
+
+	fd, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return fd.Readdir(-1)
+}
+
+func (s *SSH) syncDir(rfs Fs, rpath string, mode os.FileMode) error {
+	err := rfs.MkdirAll(rpath, mode)
+	if err != nil {
+		return err
+	}
+	return rfs.Chmod(rpath, mode)
+}
+
+func (s *SSH) syncFile(ctx context.Context, rfs Fs, rpath string, fd io.Reader, stat os.FileInfo, mode os.FileMode, sparse bool) error {
 	err := rfs.Remove(rpath)
 
 	if err != nil && !rfs.IsNotExist(err) {
@@ -613,17 +2302,16 @@ func (s *SSH) syncFile(rfs Fs, rpath string, fd io.Reader, stat os.FileInfo) err
 	dir = rfpath.FromSlash(dir)
 
 	if dir != "" {
-		err = rfs.MkdirAll(dir, 0755)
+		err = rfs.MkdirAll(dir, s.defaultDirMode())
 		if err != nil {
 			return err
 		}
 	}
 
-	rfd, err := s.openFile(rfs, rpath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, stat.Mode())
+	rfd, err := s.openFile(rfs, rpath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
 	if err != nil {
 		return err
 	}
-	defer rfd.Close()
 
 	bufsize := stat.Size()
 	if bufsize > CopyBufferSize {
@@ -632,13 +2320,108 @@ func (s *SSH) syncFile(rfs Fs, rpath string, fd io.Reader, stat os.FileInfo) err
 	if bufsize == 0 {
 		bufsize = 1
 	}
-	_, err = io.CopyBuffer(rfd, fd, make([]byte, bufsize))
+	var w io.Writer = rfd
+	if sparse {
+		w = &sparseWriter{f: rfd}
+	}
+	_, err = io.CopyBuffer(w, ctxReader{ctx: ctx, r: fd}, make([]byte, bufsize))
 	if err == io.EOF {
 		err = nil
 	}
+	if err == nil && sparse {
+		err = w.(*sparseWriter).finish()
+	}
+	if cerr := rfd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil && ctx.Err() != nil {
+		rfs.Remove(rpath)
+	}
+	if err != nil && isNoSpace(rfs, err) {
+		err = ErrNoSpace
+	}
+	return err
+}
+
+// ctxReader abort reading once the context is canceled
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(b []byte) (int, error) {
+	err := r.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	return r.r.Read(b)
+}
+
+// sparseBlockSize is the size of zero blocks skipped by sparse copying
+const sparseBlockSize = 4096
+
+// sparseWriter seek over zero blocks instead of writing them
+type sparseWriter struct {
+	f    File
+	off  int64
+	hole int64
+}
+
+func (w *sparseWriter) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		block := b
+		if len(block) > sparseBlockSize {
+			block = block[:sparseBlockSize]
+		}
+		if isZeros(block) {
+			w.hole += int64(len(block))
+			n += len(block)
+		} else {
+			if err := w.seekHole(); err != nil {
+				return n, err
+			}
+			c, err := w.f.Write(block)
+			w.off += int64(c)
+			n += c
+			if err != nil {
+				return n, err
+			}
+		}
+		b = b[len(block):]
+	}
+	return n, nil
+}
+
+func (w *sparseWriter) seekHole() error {
+	if w.hole == 0 {
+		return nil
+	}
+	_, err := w.f.Seek(w.hole, io.SeekCurrent)
+	if err == nil {
+		w.off += w.hole
+		w.hole = 0
+	}
 	return err
 }
 
+// finish extend the file to include the trailing hole
+func (w *sparseWriter) finish() error {
+	if w.hole == 0 {
+		return nil
+	}
+	return w.f.Truncate(w.off + w.hole)
+}
+
+func isZeros(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *SSH) writeFile(fs Fs, path string, data []byte) error {
 	fd, err := s.openFile(fs, path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
@@ -660,10 +2443,160 @@ func (s *SSH) readFile(fs Fs, path string) ([]byte, error) {
 	return ioutil.ReadAll(fd)
 }
 
+func (s *SSH) readFileGz(fs Fs, path string) ([]byte, error) {
+	fd, err := s.openFile(fs, path, os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	r, err := gzip.NewReader(fd)
+	if err == gzip.ErrHeader || err == io.EOF {
+		return nil, ErrNotGzip
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func (s *SSH) readFileN(fs Fs, path string, n int) ([]byte, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("%w: negative count %d", ErrInvalidRange, n)
+	}
+	fd, err := s.openFile(fs, path, os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	data := make([]byte, n)
+	n, err = io.ReadFull(fd, data)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return data[:n], err
+}
+
+// SetSafePath enable or disable path traversal checking for relative paths of
+// file operations, relative paths escaping the working directory are rejected
+// with ErrPathTraversal. Paths starting with "~" are checked the same way after
+// expanded, so they must be inside the working directory.
+func (s *SSH) SetSafePath(enable bool) {
+	s.safePath = enable
+}
+
+// SetRemoteEnv set the env applied to all remote commands, env passed to each
+// command override them. Values are quoted and exported in order of keys.
+func (s *SSH) SetRemoteEnv(env map[string]string) {
+	s.renv = copyEnv(env)
+}
+
+// RemoteEnv return a copy of the env applied to all remote commands
+func (s *SSH) RemoteEnv() map[string]string {
+	return copyEnv(s.renv)
+}
+
+// ClearRemoteEnv remove all env set by SetRemoteEnv
+func (s *SSH) ClearRemoteEnv() {
+	s.renv = nil
+}
+
+// SetLocalEnv do the same thing as SetRemoteEnv but for local host
+func (s *SSH) SetLocalEnv(env map[string]string) {
+	s.lenv = copyEnv(env)
+}
+
+// LocalEnv do the same thing as RemoteEnv but for local host
+func (s *SSH) LocalEnv() map[string]string {
+	return copyEnv(s.lenv)
+}
+
+// ClearLocalEnv do the same thing as ClearRemoteEnv but for local host
+func (s *SSH) ClearLocalEnv() {
+	s.lenv = nil
+}
+
+// WithEnv call fn with a temporary copy of current instance whose remote env is
+// merged with env, keys of env override the existing ones. Current instance is
+// unchanged except the error and output of the last operation, so chained
+// operations keep working. Like TmpRcd, the copy doesn't change reference count
+// and must not be closed or used after fn returned.
+func (s *SSH) WithEnv(env map[string]string, fn func(*SSH)) {
+	ns := *s
+	ns.renv = copyEnv(s.renv)
+	for k, v := range env {
+		ns.renv[k] = v
+	}
+	fn(&ns)
+	s.lastErr, s.lastOutput = ns.lastErr, ns.lastOutput
+}
+
+func copyEnv(env map[string]string) map[string]string {
+	m := make(map[string]string, len(env))
+	for k, v := range env {
+		m[k] = v
+	}
+	return m
+}
+
+// SetCommandWrapper set the function to wrap remote commands, it's applied to the
+// command after cd and env exporting, such as running it inside a container or
+// namespace. RcmdRaw is not affected, nil remove the wrapper.
+func (s *SSH) SetCommandWrapper(wrap func(cmd string) string) {
+	s.rwrap = wrap
+}
+
+// DisableAutoCd stop commands from changing to the current working directory
+// before running, env exporting is still applied. It's useful for jails and
+// chroots where the working directory is invalid for commands, use RcmdIn to
+// run a command in a directory explicitly.
+func (s *SSH) DisableAutoCd(disable bool) {
+	s.noAutoCd = disable
+}
+
+func (s *SSH) rsafePath(path string) (string, error) {
+	return s.checkedPath(s.rfs, s.rwd, s.rhome, path)
+}
+
+func (s *SSH) lsafePath(path string) (string, error) {
+	return s.checkedPath(s.lfs, s.cwd, s.lhome, path)
+}
+
+func (s *SSH) transferPaths(path, remotePath string) (string, string, error) {
+	path, err := s.lsafePath(path)
+	if err != nil {
+		return "", "", err
+	}
+	remotePath, err = s.rsafePath(remotePath)
+	return path, remotePath, err
+}
+
+func (s *SSH) checkedPath(fs Fs, wd, home, path string) (string, error) {
+	expanded := expandHome(fs, home, path)
+	if !s.safePath {
+		return fsPath(fs, wd, expanded), nil
+	}
+	fpath := fs.Filepath()
+	if expanded != path {
+		// home is only allowed if it's inside the working directory
+		rel, err := fpath.Rel(fpath.Clean(wd), expanded)
+		if err != nil {
+			return "", ErrPathTraversal
+		}
+		return safeJoin(fpath, wd, rel)
+	}
+	if fpath.IsAbs(path) {
+		return fsPath(fs, wd, path), nil
+	}
+	return safeJoin(fpath, wd, path)
+}
+
 func (s *SSH) rpath(path string) string {
-	return fsPath(s.rfs, s.rwd, path)
+	return fsPath(s.rfs, s.rwd, s.RexpandHome(path))
 }
 
 func (s *SSH) lpath(path string) string {
-	return fsPath(s.lfs, s.cwd, path)
+	return fsPath(s.lfs, s.cwd, s.LexpandHome(path))
 }
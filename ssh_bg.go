@@ -0,0 +1,103 @@
+package socker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// BgJob is a command started in background on remote host.
+type BgJob struct {
+	// Stdout and Stderr are the absolute paths of output files, they are equal
+	// if stderr is redirected to stdout.
+	Stdout string
+	Stderr string
+	// Pid is the process id of the job, it's 0 if the shell can't report it.
+	Pid int
+}
+
+// RcmdBgResult do the same thing as RcmdBg but return the resolved log paths
+// and the pid of the job. The pid is tracked for CloseKillBackground.
+func (s *SSH) RcmdBgResult(cmd, stdout, stderr string, env ...string) (BgJob, error) {
+	if stdout == "" {
+		stdout = "nohup.out"
+	}
+	job := BgJob{Stdout: s.rpath(stdout)}
+	if stderr == "" || stderr == stdout {
+		job.Stderr = job.Stdout
+	} else {
+		job.Stderr = s.rpath(stderr)
+	}
+
+	cmd = s.rshell.cmdStrBg(cmd, job.Stdout, job.Stderr)
+	if s.rshell.BgPid != "" {
+		cmd += " " + s.rshell.BgPid
+	}
+	cmd = s.rcmdStr(cmd, strings.Join(env, " "))
+
+	var out []byte
+	err := s.withSession(func(sess *ssh.Session) error {
+		var err error
+		out, err = sess.Output(cmd)
+		return err
+	})
+	if err != nil || s.rshell.BgPid == "" {
+		return job, err
+	}
+
+	job.Pid, err = strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		return job, fmt.Errorf("invalid pid of background job: %s", out)
+	}
+	s.bgJobs.add(job.Pid)
+	return job, nil
+}
+
+// bgJobs track pids of background jobs started on the connection
+type bgJobs struct {
+	mu   sync.Mutex
+	pids []int
+}
+
+func (j *bgJobs) add(pid int) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.pids = append(j.pids, pid)
+	j.mu.Unlock()
+}
+
+// take return all tracked pids and stop tracking them
+func (j *bgJobs) take() []int {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	pids := j.pids
+	j.pids = nil
+	j.mu.Unlock()
+	return pids
+}
+
+// CloseKillBackground send SIGTERM to background jobs started by RcmdBgResult
+// of the connection and its clones, then close the instance like Close. Jobs
+// already exited are ignored, the error of sending signals is returned. Close
+// leaves background jobs running.
+func (s *SSH) CloseKillBackground() error {
+	var err error
+	if pids := s.bgJobs.take(); len(pids) > 0 {
+		cmd := "kill -TERM"
+		for _, pid := range pids {
+			cmd += " " + strconv.Itoa(pid)
+		}
+		err = s.withSession(func(sess *ssh.Session) error {
+			return sess.Run(cmd + " 2>/dev/null; true")
+		})
+	}
+	s.Close()
+	return err
+}
@@ -0,0 +1,83 @@
+package socker
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var checksumAlgos = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// Rsha256 return the hex encoded sha256 digest of remote file
+func (s *SSH) Rsha256(path string) (string, error) {
+	return s.Rchecksum(path, "sha256")
+}
+
+// Rchecksum return the hex encoded digest of remote file, algo can be md5, sha1,
+// sha256 and sha512. It runs "<algo>sum" on remote host and fallback to streaming
+// the file and hashing locally if the tool is unavailable.
+func (s *SSH) Rchecksum(path, algo string) (string, error) {
+	newHash, has := checksumAlgos[algo]
+	if !has {
+		return "", fmt.Errorf("unsupported checksum algorithm: %s", algo)
+	}
+	path, err := s.rsafePath(path)
+	if err != nil {
+		return "", err
+	}
+
+	sum, err := s.rchecksumCmd(path, algo, newHash().Size())
+	if err == nil {
+		return sum, nil
+	}
+	return s.checksum(s.rfs, path, newHash())
+}
+
+func (s *SSH) rchecksumCmd(path, algo string, size int) (string, error) {
+	var out []byte
+	err := s.withSession(func(sess *ssh.Session) error {
+		var err error
+		out, err = sess.Output(algo + "sum " + shellQuote(path))
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	fields := bytes.Fields(out)
+	if len(fields) == 0 || len(fields[0]) != size*2 {
+		return "", fmt.Errorf("invalid output of %ssum: %s", algo, out)
+	}
+	sum := string(bytes.ToLower(fields[0]))
+	if _, err = hex.DecodeString(sum); err != nil {
+		return "", fmt.Errorf("invalid output of %ssum: %s", algo, out)
+	}
+	return sum, nil
+}
+
+func (s *SSH) checksum(fs Fs, path string, h hash.Hash) (string, error) {
+	fd, err := s.openFile(fs, path, os.O_RDONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	if _, err = io.Copy(h, fd); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
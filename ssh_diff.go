@@ -0,0 +1,126 @@
+package socker
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+type DiffKind int
+
+const (
+	DiffOnlyLocal DiffKind = iota
+	DiffOnlyRemote
+	DiffChanged
+)
+
+func (k DiffKind) String() string {
+	switch k {
+	case DiffOnlyLocal:
+		return "only-local"
+	case DiffOnlyRemote:
+		return "only-remote"
+	case DiffChanged:
+		return "changed"
+	}
+	return "unknown"
+}
+
+// DiffEntry is a different entry between local and remote tree, Path is
+// slash-separated and relative to the tree root.
+type DiffEntry struct {
+	Path   string
+	Kind   DiffKind
+	Local  os.FileInfo
+	Remote os.FileInfo
+}
+
+// Diff compare local and remote tree, report entries only exist on one side or
+// differ in type, size, mode or modify time. Directories are compared by type only.
+func (s *SSH) Diff(localPath, remotePath string) ([]DiffEntry, error) {
+	return s.DiffFilter(localPath, remotePath, nil)
+}
+
+// DiffFilter do the same thing as Diff but only compare entries accepted by the
+// filter on both sides, see SyncFilter for the rules.
+func (s *SSH) DiffFilter(localPath, remotePath string, filter *SyncFilter) ([]DiffEntry, error) {
+	err := filter.validate()
+	if err != nil {
+		return nil, err
+	}
+	localPath, remotePath, err = s.transferPaths(localPath, remotePath)
+	if err != nil {
+		return nil, err
+	}
+	locals, err := s.walkTree(s.lfs, localPath, filter)
+	if err != nil {
+		return nil, err
+	}
+	remotes, err := s.walkTree(s.rfs, remotePath, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []DiffEntry
+	for path, l := range locals {
+		r, has := remotes[path]
+		switch {
+		case !has:
+			entries = append(entries, DiffEntry{Path: path, Kind: DiffOnlyLocal, Local: l})
+		case isFileChanged(l, r):
+			entries = append(entries, DiffEntry{Path: path, Kind: DiffChanged, Local: l, Remote: r})
+		}
+	}
+	for path, r := range remotes {
+		if _, has := locals[path]; !has {
+			entries = append(entries, DiffEntry{Path: path, Kind: DiffOnlyRemote, Remote: r})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	return entries, nil
+}
+
+func isFileChanged(l, r os.FileInfo) bool {
+	if l.IsDir() || r.IsDir() {
+		return l.IsDir() != r.IsDir()
+	}
+	return l.Size() != r.Size() ||
+		l.Mode() != r.Mode() ||
+		// sftp only keeps seconds
+		l.ModTime().Unix() != r.ModTime().Unix()
+}
+
+// walkTree return all entries of the tree accepted by the filter keyed by
+// slash-separated relative path, the root itself is excluded. Missing root is
+// treated as empty tree.
+func (s *SSH) walkTree(fs Fs, root string, filter *SyncFilter) (map[string]os.FileInfo, error) {
+	fpath := fs.Filepath()
+	entries := make(map[string]os.FileInfo)
+	err := WalkDepth(fs, root, s.maxDepth, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == root && fs.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		rel, err := fpath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = fpath.ToSlash(rel)
+		if !filter.Accept(rel, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		entries[rel] = info
+		return nil
+	})
+	return entries, err
+}
@@ -0,0 +1,85 @@
+package socker
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"regexp"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	ErrExpectTimeout    = errors.New("expected output doesn't appear before timeout")
+	ErrExpectNotMatched = errors.New("command exited without expected output")
+)
+
+// RcmdExpect run the command and scan its stdout and stderr line by line, the
+// command is killed once a line matches the pattern and the line is returned.
+// If timeout elapsed ErrExpectTimeout is returned, zero timeout means no limit.
+// The env of SetRemoteEnv and WithEnv is applied like Rcmd. Output is not saved
+// as the last output.
+func (s *SSH) RcmdExpect(cmd string, pattern *regexp.Regexp, timeout time.Duration) (matched []byte, err error) {
+	s.conn.mu.RLock()
+	defer s.conn.mu.RUnlock()
+
+	cmd = s.rcmdStr(cmd, "")
+	err = s.withSession(func(sess *ssh.Session) error {
+		pr, pw := io.Pipe()
+		defer pr.Close()
+
+		sess.Stdin = s.rIn
+		sess.Stdout, sess.Stderr = pw, pw
+		err := sess.Start(cmd)
+		if err != nil {
+			return err
+		}
+		go func() {
+			pw.CloseWithError(sess.Wait())
+		}()
+
+		var (
+			lines   = make(chan []byte, 1)
+			scanErr = make(chan error, 1)
+		)
+		go func() {
+			scanner := bufio.NewScanner(pr)
+			for scanner.Scan() {
+				if pattern.Match(scanner.Bytes()) {
+					lines <- append([]byte(nil), scanner.Bytes()...)
+					return
+				}
+			}
+			scanErr <- scanner.Err()
+		}()
+
+		var timeoutChan <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			timeoutChan = timer.C
+		}
+		select {
+		case matched = <-lines:
+			killSession(sess)
+			return nil
+		case err = <-scanErr:
+			if err == nil {
+				err = ErrExpectNotMatched
+			}
+			return err
+		case <-timeoutChan:
+			killSession(sess)
+			return ErrExpectTimeout
+		}
+	})
+	return matched, err
+}
+
+// killSession signal the command and close the session, since servers such as
+// OpenSSH ignore signals and the command would keep running otherwise.
+func killSession(sess *ssh.Session) {
+	sess.Signal(ssh.SIGKILL)
+	sess.Close()
+}
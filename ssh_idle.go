@@ -0,0 +1,65 @@
+package socker
+
+import (
+	"sync"
+	"time"
+)
+
+// idleTimer close the connection once no operation is running for timeout
+type idleTimer struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	timer   *time.Timer
+	active  int
+	closed  bool
+	onIdle  func()
+}
+
+func newIdleTimer(timeout time.Duration, onIdle func()) *idleTimer {
+	t := &idleTimer{
+		timeout: timeout,
+		onIdle:  onIdle,
+	}
+	t.timer = time.AfterFunc(timeout, t.fire)
+	return t
+}
+
+func (t *idleTimer) fire() {
+	t.mu.Lock()
+	if t.closed || t.active > 0 {
+		t.mu.Unlock()
+		return
+	}
+	t.closed = true
+	t.mu.Unlock()
+
+	t.onIdle()
+}
+
+// begin stop the timer during operation, return false if it has been closed
+func (t *idleTimer) begin() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.active++
+	t.timer.Stop()
+	return true
+}
+
+func (t *idleTimer) end() {
+	t.mu.Lock()
+	t.active--
+	if !t.closed && t.active == 0 {
+		t.timer.Reset(t.timeout)
+	}
+	t.mu.Unlock()
+}
+
+func (t *idleTimer) Stop() {
+	t.mu.Lock()
+	t.closed = true
+	t.timer.Stop()
+	t.mu.Unlock()
+}
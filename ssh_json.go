@@ -0,0 +1,66 @@
+package socker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// RcmdJSON run the command and unmarshal its stdout into v if it succeeded, the
+// stderr is included in the error if the command failed. Configured pipes and
+// the state of instance are not changed.
+func (s *SSH) RcmdJSON(cmd string, v interface{}, env ...string) error {
+	_, err := s.RcmdJSONWarnings(cmd, v, env...)
+	return err
+}
+
+// RcmdJSONWarnings do the same thing as RcmdJSON but also return the stderr of
+// succeeded command as warnings, stdout and stderr are always captured
+// separately so warnings never pollute the json.
+func (s *SSH) RcmdJSONWarnings(cmd string, v interface{}, env ...string) (string, error) {
+	cmd = s.rcmdStr(cmd, strings.Join(env, " "))
+	var stdout, stderr bytes.Buffer
+	err := s.WithSession(func(sess *ssh.Session) error {
+		sess.Stdout, sess.Stderr = &stdout, &stderr
+		return sess.Run(cmd)
+	})
+	return unmarshalCmdJSON(stdout.Bytes(), stderr.Bytes(), err, v)
+}
+
+// LcmdJSON do the same thing as RcmdJSON but for local host
+func (s *SSH) LcmdJSON(cmd string, v interface{}, env ...string) error {
+	_, err := s.LcmdJSONWarnings(cmd, v, env...)
+	return err
+}
+
+// LcmdJSONWarnings do the same thing as RcmdJSONWarnings but for local host
+func (s *SSH) LcmdJSONWarnings(cmd string, v interface{}, env ...string) (string, error) {
+	c := exec.Command("sh", "-c", s.lcmdStr(cmd, strings.Join(env, " ")))
+	if len(env) > 0 {
+		c.Env = append(os.Environ(), env...)
+	}
+	var stdout, stderr bytes.Buffer
+	c.Stdout, c.Stderr = &stdout, &stderr
+	err := c.Run()
+	return unmarshalCmdJSON(stdout.Bytes(), stderr.Bytes(), err, v)
+}
+
+func unmarshalCmdJSON(stdout, stderr []byte, err error, v interface{}) (string, error) {
+	msg := strings.TrimSpace(string(stderr))
+	if err != nil {
+		if msg != "" {
+			return "", fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", err
+	}
+	err = json.Unmarshal(stdout, v)
+	if err != nil {
+		return msg, fmt.Errorf("invalid json output: %w", err)
+	}
+	return msg, nil
+}
@@ -0,0 +1,127 @@
+package socker
+
+import (
+	"os"
+	"sort"
+	"time"
+)
+
+// FileMeta is the metadata applied to a file by RapplyMetadata, zero fields are
+// kept unchanged.
+type FileMeta struct {
+	// Mode is the permission bits, zero to keep.
+	Mode os.FileMode
+	// Chown enable changing the owner to Uid and Gid since zero is a valid id.
+	Chown bool
+	Uid   int
+	Gid   int
+	// Mtime is the modify time, both times are kept if it's zero. Atime
+	// defaults to Mtime if it's zero.
+	Atime time.Time
+	Mtime time.Time
+}
+
+// RapplyMetadata walk the remote tree once and apply metadata to entries, meta is
+// keyed by slash-separated path relative to remotePath, "." for the root itself.
+// Entries are applied children first, so directory modes never block the walk.
+// It continues on failure and SyncErrors is chained, entries of meta not found
+// in the tree are reported as os.ErrNotExist.
+func (s *SSH) RapplyMetadata(remotePath string, meta map[string]FileMeta) {
+	s.withErrorCheck(func() error {
+		path, err := s.rsafePath(remotePath)
+		if err != nil {
+			return err
+		}
+		return s.applyMetadata(s.rfs, path, meta)
+	})
+}
+
+// LapplyMetadata do the same thing as RapplyMetadata but for local host
+func (s *SSH) LapplyMetadata(localPath string, meta map[string]FileMeta) {
+	s.withErrorCheck(func() error {
+		path, err := s.lsafePath(localPath)
+		if err != nil {
+			return err
+		}
+		return s.applyMetadata(s.lfs, path, meta)
+	})
+}
+
+func (s *SSH) applyMetadata(fs Fs, root string, meta map[string]FileMeta) error {
+	type entry struct {
+		path string
+		rel  string
+	}
+	var (
+		fpath   = fs.Filepath()
+		entries []entry
+		errs    SyncErrors
+		found   = make(map[string]bool, len(meta))
+	)
+	err := WalkDepth(fs, root, s.maxDepth, func(path string, info os.FileInfo, err error) error {
+		rel, relErr := fpath.Rel(root, path)
+		if relErr != nil {
+			return relErr
+		}
+		rel = fpath.ToSlash(rel)
+		if err != nil {
+			if path == root {
+				return err
+			}
+			errs = append(errs, SyncError{Path: rel, Err: err})
+			return nil
+		}
+		if _, has := meta[rel]; has {
+			found[rel] = true
+			entries = append(entries, entry{path: path, rel: rel})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if err := applyFileMeta(fs, e.path, meta[e.rel]); err != nil {
+			errs = append(errs, SyncError{Path: e.rel, Err: err})
+		}
+	}
+	var missing []string
+	for rel := range meta {
+		if !found[rel] {
+			missing = append(missing, rel)
+		}
+	}
+	sort.Strings(missing)
+	for _, rel := range missing {
+		errs = append(errs, SyncError{Path: rel, Err: os.ErrNotExist})
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// applyFileMeta change owner before mode since chown may clear the setuid and
+// setgid bits.
+func applyFileMeta(fs Fs, path string, meta FileMeta) error {
+	if meta.Chown {
+		if err := fs.Chown(path, meta.Uid, meta.Gid); err != nil {
+			return err
+		}
+	}
+	if meta.Mode != 0 {
+		if err := fs.Chmod(path, meta.Mode); err != nil {
+			return err
+		}
+	}
+	if !meta.Mtime.IsZero() {
+		atime := meta.Atime
+		if atime.IsZero() {
+			atime = meta.Mtime
+		}
+		return fs.Chtimes(path, atime, meta.Mtime)
+	}
+	return nil
+}
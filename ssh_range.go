@@ -0,0 +1,51 @@
+package socker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var ErrInvalidRange = errors.New("invalid byte range")
+
+// GetRange download length bytes of remote file starting at offset into local
+// file, length -1 means to the end of file. ErrInvalidRange is returned if the
+// range exceeds the file size.
+func (s *SSH) GetRange(remotePath, localPath string, offset, length int64) {
+	s.withErrorCheck(func() error {
+		path, remotePath, err := s.transferPaths(localPath, remotePath)
+		if err != nil {
+			return err
+		}
+		ctx := context.Background()
+		err = s.acquireTransfer(ctx)
+		if err != nil {
+			return err
+		}
+		defer s.releaseTransfer()
+
+		fd, err := s.openFile(s.rfs, remotePath, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		stat, err := fd.Stat()
+		if err != nil {
+			return err
+		}
+
+		size := stat.Size()
+		if length == -1 && offset >= 0 && offset <= size {
+			length = size - offset
+		}
+		if offset < 0 || length < 0 || offset > size || length > size-offset {
+			return fmt.Errorf("%w: offset %d, length %d, file size %d", ErrInvalidRange, offset, length, size)
+		}
+		if _, err = fd.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		return s.syncFile(ctx, s.lfs, path, io.LimitReader(fd, length), stat, stat.Mode(), false)
+	})
+}
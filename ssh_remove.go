@@ -0,0 +1,87 @@
+package socker
+
+import (
+	"os"
+)
+
+// RremoveAllProgress remove the remote path and all its children like
+// Rremove(path, true) but continue on failure, onRemove is called after each
+// entry is removed and onError for each failure, both can be nil. Directories
+// containing failed entries are left untouched without being reported again.
+// Failures are returned as SyncErrors keyed by the full path, missing path is not
+// an error. The state of instance is not changed.
+func (s *SSH) RremoveAllProgress(path string, onRemove func(path string), onError func(path string, err error)) error {
+	path, err := s.rsafePath(path)
+	if err != nil {
+		return err
+	}
+	return s.removeAllProgress(s.rfs, path, onRemove, onError)
+}
+
+// LremoveAllProgress do the same thing as RremoveAllProgress but for local host
+func (s *SSH) LremoveAllProgress(path string, onRemove func(path string), onError func(path string, err error)) error {
+	path, err := s.lsafePath(path)
+	if err != nil {
+		return err
+	}
+	return s.removeAllProgress(s.lfs, path, onRemove, onError)
+}
+
+func (s *SSH) removeAllProgress(fs Fs, root string, onRemove func(path string), onError func(path string, err error)) error {
+	var (
+		fpath = fs.Filepath()
+		paths []string
+		errs  SyncErrors
+		// directories can't be removed since some children failed
+		blocked = make(map[string]bool)
+	)
+	fail := func(path string, err error) {
+		errs = append(errs, SyncError{Path: path, Err: err})
+		if onError != nil {
+			onError(path, err)
+		}
+		for path != root {
+			path = fpath.Dir(path)
+			if blocked[path] {
+				break
+			}
+			blocked[path] = true
+		}
+	}
+
+	// like Rremove, nothing is removed if the tree is too deep
+	err := WalkDepth(fs, root, s.maxDepth, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if !fs.IsNotExist(err) {
+				fail(path, err)
+				blocked[path] = true
+			}
+			return nil
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// children are always walked after parent
+	for i := len(paths) - 1; i >= 0; i-- {
+		path := paths[i]
+		if blocked[path] {
+			continue
+		}
+		err := fs.Remove(path)
+		switch {
+		case err == nil:
+			if onRemove != nil {
+				onRemove(path)
+			}
+		case !fs.IsNotExist(err):
+			fail(path, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
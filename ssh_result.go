@@ -0,0 +1,61 @@
+package socker
+
+import (
+	"bytes"
+	"sort"
+)
+
+// CmdResult is the result of a command run on a single host.
+type CmdResult struct {
+	Output []byte
+	Err    error
+}
+
+// CmdResults holds command results keyed by host addr, it's independent of how
+// the command was fanned out.
+type CmdResults map[string]CmdResult
+
+func (r CmdResults) addrs(failed bool) []string {
+	var addrs []string
+	for addr, res := range r {
+		if (res.Err != nil) == failed {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Failed return sorted addrs whose command failed
+func (r CmdResults) Failed() []string {
+	return r.addrs(true)
+}
+
+// Succeeded return sorted addrs whose command succeeded
+func (r CmdResults) Succeeded() []string {
+	return r.addrs(false)
+}
+
+// CombinedOutput return outputs of all hosts sorted by addr, each one is
+// prefixed with a "[addr]" line and followed by the error if exist.
+func (r CmdResults) CombinedOutput() string {
+	addrs := make([]string, 0, len(r))
+	for addr := range r {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var buf bytes.Buffer
+	for _, addr := range addrs {
+		res := r[addr]
+		buf.WriteString("[" + addr + "]\n")
+		buf.Write(res.Output)
+		if len(res.Output) > 0 && res.Output[len(res.Output)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+		if res.Err != nil {
+			buf.WriteString("error: " + res.Err.Error() + "\n")
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,27 @@
+package socker
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCmdResults(t *testing.T) {
+	results := CmdResults{
+		"10.0.0.2": {Output: []byte("ok")},
+		"10.0.0.1": {Output: []byte("fail\n"), Err: errors.New("exit status 1")},
+		"10.0.0.3": {},
+	}
+
+	if got := results.Failed(); !reflect.DeepEqual(got, []string{"10.0.0.1"}) {
+		t.Errorf("failed hosts: %v", got)
+	}
+	if got := results.Succeeded(); !reflect.DeepEqual(got, []string{"10.0.0.2", "10.0.0.3"}) {
+		t.Errorf("succeeded hosts: %v", got)
+	}
+
+	expect := "[10.0.0.1]\nfail\nerror: exit status 1\n[10.0.0.2]\nok\n[10.0.0.3]\n"
+	if got := results.CombinedOutput(); got != expect {
+		t.Errorf("combined output: expect %q, got %q", expect, got)
+	}
+}
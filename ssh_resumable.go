@@ -0,0 +1,117 @@
+package socker
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+)
+
+// manifestEntry is a downloaded file recorded in the manifest of GetResumable,
+// Path is slash-separated and relative to the tree root.
+type manifestEntry struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+}
+
+// GetResumable do the same thing as Get but record downloaded files in the local
+// manifest, files recorded with the same remote size and modify time are skipped
+// if the local copy still has the same size. It's useful to resume downloading
+// large trees after interruption, run it with the same manifest again.
+func (s *SSH) GetResumable(remotePath, path, manifestPath string) {
+	s.withErrorCheck(func() error {
+		path, remotePath, err := s.transferPaths(path, remotePath)
+		if err != nil {
+			return err
+		}
+		manifestPath, err = s.lsafePath(manifestPath)
+		if err != nil {
+			return err
+		}
+		done, err := readManifest(s.lfs, manifestPath)
+		if err != nil {
+			return err
+		}
+		mf, err := s.lfs.OpenFile(manifestPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer mf.Close()
+
+		enc := json.NewEncoder(mf)
+		rfpath, lfpath := s.rfs.Filepath(), s.lfs.Filepath()
+		return WalkDepth(s.rfs, remotePath, s.maxDepth, func(rpath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := rfpath.Rel(remotePath, rpath)
+			if err != nil {
+				return err
+			}
+			lpath := lfpath.Join(path, lfpath.FromSlash(rfpath.ToSlash(rel)))
+			if info.IsDir() {
+				return s.lfs.MkdirAll(lpath, info.Mode().Perm())
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			entry := manifestEntry{Path: rfpath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime().Unix()}
+			if done[entry.Path] == entry {
+				stat, err := s.lfs.Stat(lpath)
+				if err == nil && stat.Size() == entry.Size {
+					return nil
+				}
+			}
+			err = s.getFile(rpath, lpath, info)
+			if err != nil {
+				return err
+			}
+			return enc.Encode(entry)
+		})
+	})
+}
+
+func (s *SSH) getFile(remotePath, path string, info os.FileInfo) error {
+	fd, err := s.rfs.Open(remotePath)
+	if err != nil {
+		return err
+	}
+	err = s.syncFile(context.Background(), s.lfs, path, fd, info, info.Mode(), false)
+	fd.Close()
+	if err != nil {
+		return err
+	}
+	return s.lfs.Chtimes(path, info.ModTime(), info.ModTime())
+}
+
+// readManifest read entries of manifest, the incomplete last entry written
+// during interruption is ignored.
+func readManifest(fs Fs, path string) (map[string]manifestEntry, error) {
+	entries := make(map[string]manifestEntry)
+	fd, err := fs.Open(path)
+	if err != nil {
+		if fs.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	defer fd.Close()
+
+	dec := json.NewDecoder(fd)
+	for {
+		var entry manifestEntry
+		err = dec.Decode(&entry)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			if _, ok := err.(*json.SyntaxError); ok || err == io.ErrUnexpectedEOF {
+				return entries, nil
+			}
+			return nil, err
+		}
+		entries[entry.Path] = entry
+	}
+}
@@ -69,14 +69,12 @@ func (p *sessionPool) Close() {
 	if p.size <= 0 {
 		return
 	}
+	p.mu.Lock()
 	if p.c != nil {
-		p.mu.Lock()
-		if p.c != nil {
-			close(p.c)
-			p.c = nil
-		}
-		p.mu.Unlock()
+		close(p.c)
+		p.c = nil
 	}
+	p.mu.Unlock()
 }
 
 func (p *sessionPool) takeWithTimeout() bool {
@@ -0,0 +1,86 @@
+package socker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	ErrInsufficientSpace = errors.New("insufficient space on destination")
+	ErrStatfsUnsupported = errors.New("space usage is unsupported by the filesystem")
+)
+
+// Rstatfs return the space usage of the remote filesystem containing path,
+// ErrStatfsUnsupported is returned if the filesystem can't report it.
+func (s *SSH) Rstatfs(path string) (Statfs, error) {
+	path, err := s.rsafePath(path)
+	if err != nil {
+		return Statfs{}, err
+	}
+	return statfs(s.rfs, path)
+}
+
+func statfs(fs Fs, path string) (Statfs, error) {
+	sfs, ok := fs.(StatfsFs)
+	if !ok {
+		return Statfs{}, ErrStatfsUnsupported
+	}
+	return sfs.Statfs(path)
+}
+
+// PutCheckSpace do the same thing as Put but check the available space of remote
+// filesystem before uploading, ErrInsufficientSpace is returned if the total
+// size of files is larger. It costs an extra round trip, existing files to be
+// overwritten are not counted as free.
+func (s *SSH) PutCheckSpace(path, remotePath string) {
+	s.withErrorCheck(func() error {
+		path, remotePath, err := s.transferPaths(path, remotePath)
+		if err != nil {
+			return err
+		}
+		needed, err := s.treeSize(s.lfs, path)
+		if err != nil {
+			return err
+		}
+		st, err := statfs(s.rfs, existingAncestor(s.rfs, remotePath))
+		if err != nil {
+			return err
+		}
+		if st.Avail < needed {
+			return fmt.Errorf("%w: need %d bytes, %d available", ErrInsufficientSpace, needed, st.Avail)
+		}
+		return s.transfer(context.Background(), &syncOptions{}, s.lfs, s.rfs, path, remotePath)
+	})
+}
+
+// treeSize return the total size of regular files in the tree
+func (s *SSH) treeSize(fs Fs, root string) (uint64, error) {
+	var size uint64
+	err := WalkDepth(fs, root, s.maxDepth, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	return size, err
+}
+
+// existingAncestor return the nearest existing path of path and its parents
+func existingAncestor(fs Fs, path string) string {
+	fpath := fs.Filepath()
+	for {
+		if _, err := fs.Stat(path); err == nil {
+			return path
+		}
+		parent := fpath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
@@ -0,0 +1,84 @@
+package socker
+
+import (
+	"bytes"
+	"io"
+)
+
+// tailChunkSize is the size of chunks read backward from the end of file
+const tailChunkSize = 4096
+
+// RtailLines return the last n lines of remote file without the line endings,
+// the file is read backward from the end in chunks so only the tail is
+// transferred. The last line is returned even if it has no trailing newline.
+func (s *SSH) RtailLines(path string, n int) ([]string, error) {
+	path, err := s.rsafePath(path)
+	if err != nil {
+		return nil, err
+	}
+	return tailLines(s.rfs, path, n)
+}
+
+// LtailLines do the same thing as RtailLines but for local host
+func (s *SSH) LtailLines(path string, n int) ([]string, error) {
+	path, err := s.lsafePath(path)
+	if err != nil {
+		return nil, err
+	}
+	return tailLines(s.lfs, path, n)
+}
+
+func tailLines(fs Fs, path string, n int) ([]string, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	fd, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	stat, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.IsDir() {
+		return nil, ErrIsDir
+	}
+
+	var (
+		pos  = stat.Size()
+		data []byte
+	)
+	for pos > 0 {
+		size := int64(tailChunkSize)
+		if size > pos {
+			size = pos
+		}
+		pos -= size
+		if _, err = fd.Seek(pos, io.SeekStart); err != nil {
+			return nil, err
+		}
+		chunk := make([]byte, size, int(size)+len(data))
+		if _, err = io.ReadFull(fd, chunk); err != nil {
+			return nil, err
+		}
+		data = append(chunk, data...)
+		// the line before n newlines may be partial unless the file begins
+		if bytes.Count(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) >= n {
+			break
+		}
+	}
+	if len(data) == 0 {
+		return []string{}, nil
+	}
+
+	lines := bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	res := make([]string, len(lines))
+	for i, line := range lines {
+		res[i] = string(bytes.TrimSuffix(line, []byte("\r")))
+	}
+	return res, nil
+}
@@ -0,0 +1,100 @@
+package socker
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultRemoteTempDir is the remote directory of temporary files if neither
+// SetRemoteTempDir nor the target is given.
+const DefaultRemoteTempDir = "/tmp"
+
+var ErrTempDirNotWritable = errors.New("remote temp directory isn't writable")
+
+// remoteTempDir is the directory set by SetRemoteTempDir, it's shared by clones
+// so the directory is checked only once.
+type remoteTempDir struct {
+	dir string
+
+	mu sync.Mutex
+	// the absolute path checked to be writable
+	verified string
+}
+
+// SetRemoteTempDir set the remote directory of temporary files, it's needed on
+// hosts where /tmp is full or mounted noexec. Relative path is based on the
+// remote working directory. It isn't checked until first used by RemoteTempDir,
+// empty dir restore the default. No operation of this package uses temporary
+// files for now, it's consulted through RemoteTempDir by callers such as
+// uploading scripts to run.
+func (s *SSH) SetRemoteTempDir(dir string) {
+	s.rtmpDir = nil
+	if dir != "" {
+		s.rtmpDir = &remoteTempDir{dir: dir}
+	}
+}
+
+// RemoteTempDir return the remote directory for temporary files of target, it's
+// the directory set by SetRemoteTempDir if any, otherwise the directory of
+// target so that renaming the temporary file to it is atomic, or
+// DefaultRemoteTempDir if target is empty. The directory set by
+// SetRemoteTempDir is checked to be writable on first call,
+// ErrTempDirNotWritable is returned if not. The result of check is cached and
+// shared by clones, it's safe for concurrent use.
+func (s *SSH) RemoteTempDir(target string) (string, error) {
+	tmp := s.rtmpDir
+	if tmp == nil {
+		if target == "" {
+			return DefaultRemoteTempDir, nil
+		}
+		target, err := s.rsafePath(target)
+		if err != nil {
+			return "", err
+		}
+		return s.rfs.Filepath().Dir(target), nil
+	}
+
+	dir, err := s.rsafePath(tmp.dir)
+	if err != nil {
+		return "", err
+	}
+	tmp.mu.Lock()
+	defer tmp.mu.Unlock()
+	if tmp.verified != dir {
+		if err = s.checkWritable(dir); err != nil {
+			return "", err
+		}
+		tmp.verified = dir
+	}
+	return dir, nil
+}
+
+// checkWritable check the remote dir by creating and removing a probe file, or
+// by "test -w" if sftp is unavailable.
+func (s *SSH) checkWritable(dir string) error {
+	if isFsUnavailable(s.rfs) {
+		err := s.withSession(func(sess *ssh.Session) error {
+			return sess.Run("test -d " + shellQuote(dir) + " -a -w " + shellQuote(dir))
+		})
+		if exitCode(err) > 0 {
+			return ErrTempDirNotWritable
+		}
+		return err
+	}
+
+	probe := s.rfs.Filepath().Join(dir, ".socker-probe-"+strconv.FormatInt(time.Now().UnixNano(), 36))
+	fd, err := s.rfs.OpenFile(probe, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		if s.rfs.IsNotExist(err) || s.rfs.IsPermission(err) {
+			return ErrTempDirNotWritable
+		}
+		return err
+	}
+	fd.Close()
+	return s.rfs.Remove(probe)
+}
@@ -0,0 +1,1738 @@
+package socker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "socker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestPutContext(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	local := LocalOnly()
+	local.LwriteFile(src, []byte("socker"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	local.PutContext(ctx, src, dst)
+	if local.Error() != context.Canceled {
+		t.Errorf("expect canceled error, got %v", local.Error())
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("destination should not exist: %v", err)
+	}
+
+	local.ClearError()
+	local.PutContext(context.Background(), src, dst)
+	if data := local.RreadFile(dst); string(data) != "socker" {
+		t.Errorf("put failed: %s, %v", data, local.Error())
+	}
+}
+
+func TestExpandHome(t *testing.T) {
+	local := LocalOnly()
+	local.rhome = "/home/socker"
+
+	cases := map[string]string{
+		"~":         "/home/socker",
+		"~/remote":  "/home/socker/remote",
+		"~remote":   "~remote",
+		"/tmp/~/a":  "/tmp/~/a",
+		"remote/~/": "remote/~/",
+	}
+	for path, expect := range cases {
+		if got := local.RexpandHome(path); got != expect {
+			t.Errorf("expand %s: expect %s, got %s", path, expect, got)
+		}
+	}
+}
+
+func TestCloseResult(t *testing.T) {
+	local := LocalOnly()
+	local.Lcmd("echo socker && exit 1")
+
+	output, err := local.CloseResult()
+	if string(output) != "socker\n" || err == nil {
+		t.Errorf("unexpected result: %q, %v", output, err)
+	}
+	if local.Output() != nil || local.Error() != nil {
+		t.Error("result should be cleaned after close")
+	}
+}
+
+func TestLcmdEnvFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	local := LocalOnly()
+	local.LwriteFile(filepath.Join(dir, ".env"), []byte("# comment\nFOO='foo bar'\nBAR=\"bar\"\n"))
+	local.LcmdEnvFile("sh -c 'echo $FOO $BAR'", filepath.Join(dir, ".env"))
+	if string(local.Output()) != "foo bar bar\n" || local.Error() != nil {
+		t.Errorf("unexpected result: %q, %v", local.Output(), local.Error())
+	}
+}
+
+func TestReadFileN(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	local := LocalOnly()
+	local.LwriteFile(path, []byte("socker"))
+	if data := local.RreadFileN(path, 3); string(data) != "soc" {
+		t.Errorf("read first 3 bytes: %q", data)
+	}
+	if data := local.RreadFileN(path, 10); string(data) != "socker" {
+		t.Errorf("read short file: %q", data)
+	}
+	if local.Error() != nil {
+		t.Error(local.Error())
+	}
+	if local.RreadFileN(path, -1); !errors.Is(local.Error(), ErrInvalidRange) {
+		t.Errorf("expect invalid range error, got %v", local.Error())
+	}
+}
+
+func TestGetGlob(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	local := LocalOnly()
+	local.Rcd(dir)
+	local.Lcd(dir)
+	local.Lcmd("mkdir -p remote/b.log remote/c")
+	local.RwriteFile("remote/a.log", nil)
+	local.RwriteFile("remote/b.log/e", nil)
+	local.RwriteFile("remote/c/d.log", nil)
+	if local.Error() != nil {
+		t.Fatal(local.Error())
+	}
+
+	if matches := local.Rglob("remote/*/*.log"); len(matches) != 1 || matches[0] != filepath.Join(dir, "remote/c/d.log") {
+		t.Errorf("glob failed: %v", matches)
+	}
+
+	local.GetGlob("remote/*.log", "local", false)
+	if local.Error() == nil {
+		t.Error("directory should be rejected")
+	}
+	local.ClearError()
+
+	local.GetGlob("remote/*.log", "local", true)
+	if !local.Lexists("local/a.log") || !local.Lexists("local/b.log/e") || local.Error() != nil {
+		t.Errorf("get glob failed: %v", local.Error())
+	}
+}
+
+// handleCountFs record the max number of simultaneously opened files
+type handleCountFs struct {
+	*FsMem
+	open, max int32
+}
+
+func (f *handleCountFs) Open(name string) (File, error) {
+	fd, err := f.FsMem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	n := atomic.AddInt32(&f.open, 1)
+	for {
+		max := atomic.LoadInt32(&f.max)
+		if n <= max || atomic.CompareAndSwapInt32(&f.max, max, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	return handleCountFile{File: fd, fs: f}, nil
+}
+
+type handleCountFile struct {
+	File
+	fs *handleCountFs
+}
+
+func (f handleCountFile) Close() error {
+	atomic.AddInt32(&f.fs.open, -1)
+	return f.File.Close()
+}
+
+func TestTransferConcurrency(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	fs := &handleCountFs{FsMem: NewFsMem()}
+	fs.MkdirAll("/remote/dir", 0755)
+	for i := 0; i < 8; i++ {
+		name := "/remote/" + strconv.Itoa(i) + ".log"
+		if i%2 == 1 {
+			name = "/remote/dir/" + strconv.Itoa(i) + ".log"
+		}
+		fd, _ := fs.Create(name)
+		fd.WriteString(name)
+		fd.Close()
+	}
+
+	s := LocalOnly()
+	s.SetRemoteFs(fs)
+	s.Rcd("/remote")
+	s.SetTransferConcurrency(2)
+	s.GetGlob("*", dir, true)
+	if err := s.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if max := atomic.LoadInt32(&fs.max); max > 2 {
+		t.Errorf("expect at most 2 open handles, got %d", max)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "dir", "7.log")); err != nil || string(data) != "/remote/dir/7.log" {
+		t.Errorf("get failed: %s, %v", data, err)
+	}
+	if atomic.LoadInt32(&fs.open) != 0 {
+		t.Error("all handles should be closed")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	local := LocalOnly()
+	local.SetIdleTimeout(20 * time.Millisecond)
+
+	local.Lcmd("sleep 0.05")
+	if local.Error() != nil {
+		t.Fatal("running command should not be interrupted:", local.Error())
+	}
+	time.Sleep(50 * time.Millisecond)
+	local.Lcmd("true")
+	if local.Error() != ErrConnClosed {
+		t.Errorf("expect connection closed, got %v", local.Error())
+	}
+	if err := local.RcdChecked("/"); err != ErrConnClosed {
+		t.Errorf("expect connection closed for checked cd, got %v", err)
+	}
+}
+
+func TestSafePath(t *testing.T) {
+	var fs FsLocal
+	if path, err := safeJoin(fs.Filepath(), "/srv/data", "a/../b"); err != nil || path != "/srv/data/b" {
+		t.Errorf("safe join failed: %s, %v", path, err)
+	}
+	if _, err := safeJoin(fs.Filepath(), "/srv/data", "../../etc/passwd"); err != ErrPathTraversal {
+		t.Errorf("expect path traversal error, got %v", err)
+	}
+
+	local := LocalOnly()
+	local.Lcd("/srv/data")
+	local.SetSafePath(true)
+	local.LreadFile("../../etc/passwd")
+	if local.Error() != ErrPathTraversal {
+		t.Errorf("expect path traversal error, got %v", local.Error())
+	}
+
+	local = LocalOnly()
+	local.lhome = "/home/socker"
+	local.Lcd("/home/socker/app")
+	local.SetSafePath(true)
+	for _, path := range []string{"~", "~/../../etc/passwd", "~/.ssh/id_rsa"} {
+		if _, err := local.lsafePath(path); err != ErrPathTraversal {
+			t.Errorf("%s: expect path traversal error, got %v", path, err)
+		}
+	}
+	if path, err := local.lsafePath("~/app/data"); err != nil || path != "/home/socker/app/data" {
+		t.Errorf("home inside working directory should be allowed: %s, %v", path, err)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, ".deployed")
+	local := LocalOnly()
+	local.Ltouch(path)
+	stat, err := os.Stat(path)
+	if err != nil || local.Error() != nil {
+		t.Fatal(err, local.Error())
+	}
+
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes(path, past, past)
+	local.Ltouch(path)
+	if stat, _ = os.Stat(path); !stat.ModTime().After(past) {
+		t.Error("mtime should be updated")
+	}
+}
+
+func TestReaddirEach(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	local := LocalOnly()
+	local.Lcd(dir)
+	for i := 0; i < 250; i++ {
+		local.Ltouch(strconv.Itoa(i))
+	}
+
+	var count int
+	local.LreaddirEach(".", func(os.FileInfo) error {
+		count++
+		return nil
+	})
+	if count != 250 || local.Error() != nil {
+		t.Errorf("expect 250 entries, got %d, %v", count, local.Error())
+	}
+
+	errStop := errors.New("stop")
+	count = 0
+	local.LreaddirEach(".", func(os.FileInfo) error {
+		count++
+		if count == 10 {
+			return errStop
+		}
+		return nil
+	})
+	if count != 10 || local.Error() != errStop {
+		t.Errorf("expect stop at 10, got %d, %v", count, local.Error())
+	}
+}
+
+func TestDiff(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	local := LocalOnly()
+	local.Lcd(dir)
+	local.Rcd(dir)
+	local.Lcmd("mkdir -p local/dir remote/dir")
+	local.LwriteFile("local/same", []byte("same"))
+	local.LwriteFile("local/dir/changed", []byte("local"))
+	local.LwriteFile("local/only", nil)
+	local.RwriteFile("remote/dir/changed", []byte("remote!"))
+	local.RwriteFile("remote/dir/only", nil)
+	local.Put("local/same", "remote/same")
+	if local.Error() != nil {
+		t.Fatal(local.Error())
+	}
+	mtime := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, "local/same"), mtime, mtime)
+	os.Chtimes(filepath.Join(dir, "remote/same"), mtime, mtime)
+
+	entries, err := local.Diff("local", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []struct {
+		Path string
+		Kind DiffKind
+	}{
+		{"dir/changed", DiffChanged},
+		{"dir/only", DiffOnlyRemote},
+		{"only", DiffOnlyLocal},
+	}
+	if len(entries) != len(expect) {
+		t.Fatalf("unexpected diff entries: %v", entries)
+	}
+	for i, e := range expect {
+		if entries[i].Path != e.Path || entries[i].Kind != e.Kind {
+			t.Errorf("entry %d: expect %s %s, got %s %s", i, e.Path, e.Kind, entries[i].Path, entries[i].Kind)
+		}
+	}
+}
+
+func TestPutWithModes(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	local := LocalOnly()
+	local.Lcd(dir)
+	local.Rcd(dir)
+	local.Lcmd("mkdir -p release/bin")
+	local.LwriteFile("release/bin/start.sh", []byte("#!/bin/sh"))
+	local.LwriteFile("release/README", nil)
+	local.PutWithModes("release", "remote", map[string]os.FileMode{"bin/start.sh": 0755})
+	if local.Error() != nil {
+		t.Fatal(local.Error())
+	}
+
+	for path, mode := range map[string]os.FileMode{"remote/bin/start.sh": 0755, "remote/README": 0644} {
+		stat, err := os.Stat(filepath.Join(dir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Mode().Perm() != mode {
+			t.Errorf("mode of %s: expect %o, got %o", path, mode, stat.Mode().Perm())
+		}
+	}
+}
+
+func TestPutExclude(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	local := LocalOnly()
+	local.Lcd(dir)
+	local.Rcd(dir)
+	local.Lcmd("mkdir -p app/.git/objects app/src/node_modules/pkg app/build")
+	local.LwriteFile("app/.git/objects/a", nil)
+	local.LwriteFile("app/src/node_modules/pkg/index.js", nil)
+	local.LwriteFile("app/src/main.go", nil)
+	local.LwriteFile("app/src/cache.tmp", nil)
+	local.LwriteFile("app/build/app.o", nil)
+	local.LwriteFile("app/build/app", nil)
+	local.PutExclude("app", "remote", []string{".git", "node_modules", "*.tmp", "build/*.o"})
+	if local.Error() != nil {
+		t.Fatal(local.Error())
+	}
+
+	for path, exist := range map[string]bool{
+		"remote/.git":                       false,
+		"remote/src/node_modules":           false,
+		"remote/src/node_modules/pkg":       false,
+		"remote/src/cache.tmp":              false,
+		"remote/build/app.o":                false,
+		"remote/src/main.go":                true,
+		"remote/build/app":                  true,
+		"app/src/node_modules/pkg/index.js": true,
+	} {
+		if local.Rexists(path) != exist {
+			t.Errorf("existence of %s: expect %t", path, exist)
+		}
+	}
+
+	local.PutExclude("app", "remote", []string{"["})
+	if local.Error() == nil {
+		t.Error("invalid pattern should be rejected")
+	}
+}
+
+func TestReadFileGz(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte("socker log"))
+	w.Close()
+
+	local := LocalOnly()
+	local.Lcd(dir)
+	local.LwriteFile("app.log.gz", buf.Bytes())
+	local.LwriteFile("app.log", []byte("socker log"))
+	if data := local.RreadFileGz(filepath.Join(dir, "app.log.gz")); string(data) != "socker log" {
+		t.Errorf("read gzip file failed: %q, %v", data, local.Error())
+	}
+
+	local.LreadFileGz("app.log")
+	if local.Error() != ErrNotGzip {
+		t.Errorf("expect not gzip error, got %v", local.Error())
+	}
+}
+
+func TestWaitFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	local := LocalOnly()
+	local.Rcd(dir)
+	if err := local.RwaitFile("ready", 30*time.Millisecond, 10*time.Millisecond); err != ErrWaitTimeout {
+		t.Errorf("expect wait timeout, got %v", err)
+	}
+	// non-positive poll falls back to the default instead of panicking
+	if err := local.RwaitFile("ready", 30*time.Millisecond, 0); err != ErrWaitTimeout {
+		t.Errorf("expect wait timeout with zero poll, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		ioutil.WriteFile(filepath.Join(dir, "ready"), nil, 0644)
+	}()
+	if err := local.RwaitFile("ready", time.Second, 10*time.Millisecond); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRchecksum(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	local := LocalOnly()
+	local.Rcd(dir)
+	local.RwriteFile("file", []byte("socker"))
+
+	sum, err := local.Rsha256("file")
+	h := sha256.Sum256([]byte("socker"))
+	expect := hex.EncodeToString(h[:])
+	if err != nil || sum != expect {
+		t.Errorf("sha256 failed: %s, %v", sum, err)
+	}
+	if _, err = local.Rchecksum("file", "crc32"); err == nil {
+		t.Error("unsupported algorithm should be rejected")
+	}
+}
+
+func TestDisableAutoCd(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	sub := filepath.Join(dir, "sub")
+	os.Mkdir(sub, 0755)
+
+	local := LocalOnly()
+	local.Lcd(dir)
+	local.DisableAutoCd(true)
+	local.Lcmd("pwd")
+	if strings.TrimSpace(string(local.Output())) == dir {
+		t.Error("auto cd should be disabled")
+	}
+	local.LcmdIn("sub", "pwd")
+	if got := strings.TrimSpace(string(local.Output())); got != sub {
+		t.Errorf("expect running in %s, got %s", sub, got)
+	}
+	local.DisableAutoCd(false)
+	local.Lcmd("pwd")
+	if got := strings.TrimSpace(string(local.Output())); got != dir {
+		t.Errorf("expect running in %s, got %s", dir, got)
+	}
+	if err := local.Error(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRcmdBgResultPaths(t *testing.T) {
+	local := LocalOnly()
+	local.Rcd("/tmp")
+
+	job, err := local.RcmdBgResult("sleep 1", "", "")
+	if err != ErrConnClosed {
+		t.Errorf("expect connection closed error, got %v", err)
+	}
+	if job.Stdout != "/tmp/nohup.out" || job.Stderr != job.Stdout {
+		t.Errorf("unexpected log paths: %+v", job)
+	}
+
+	job, _ = local.RcmdBgResult("sleep 1", "out.log", "/var/log/err.log")
+	if job.Stdout != "/tmp/out.log" || job.Stderr != "/var/log/err.log" {
+		t.Errorf("unexpected log paths: %+v", job)
+	}
+}
+
+func TestCmdSeparator(t *testing.T) {
+	local := LocalOnly()
+	local.Rcd("/tmp")
+	if got := local.rcmdStr("echo", "A=1"); got != "cd /tmp "+CmdSeperator+" export A=1 "+CmdSeperator+" echo" {
+		t.Errorf("default separator not used: %q", got)
+	}
+
+	local.SetCmdSeparator(";")
+	if got := local.rcmdStr("echo", "A=1"); got != "cd /tmp ; export A=1 ; echo" {
+		t.Errorf("custom separator not used: %q", got)
+	}
+	if got := LocalOnly().rcmdStr("echo", "A=1"); got != " export A=1 "+CmdSeperator+" echo" {
+		t.Errorf("separator should be per instance: %q", got)
+	}
+}
+
+func TestWithEnv(t *testing.T) {
+	local := LocalOnly()
+	local.SetRemoteEnv(map[string]string{"A": "1", "B": "2"})
+	_, refs := local.Status()
+
+	local.WithEnv(map[string]string{"B": "3", "C": "4"}, func(s *SSH) {
+		if env := s.RemoteEnv(); len(env) != 3 || env["A"] != "1" || env["B"] != "3" {
+			t.Errorf("unexpected scoped env: %v", env)
+		}
+		s.SetError(errors.New("stage failed"))
+	})
+	if env := local.RemoteEnv(); len(env) != 2 || env["B"] != "2" {
+		t.Errorf("env should be restored: %v", env)
+	}
+	if local.Error() == nil || local.Error().Error() != "stage failed" {
+		t.Errorf("error should be kept: %v", local.Error())
+	}
+	if _, r := local.Status(); r != refs {
+		t.Errorf("reference count should be unchanged: %d, %d", refs, r)
+	}
+}
+
+func TestRemoteEnv(t *testing.T) {
+	local := LocalOnly()
+	local.SetRemoteEnv(map[string]string{"B": "it's", "A": "1"})
+
+	expect := " export A='1' B='it'\\''s' A=2 " + CmdSeperator + " echo"
+	if got := local.rcmdStr("echo", "A=2"); got != expect {
+		t.Errorf("expect %q, got %q", expect, got)
+	}
+	if env := local.RemoteEnv(); len(env) != 2 || env["A"] != "1" {
+		t.Errorf("unexpected remote env: %v", env)
+	}
+
+	local.ClearRemoteEnv()
+	if got := local.rcmdStr("echo", ""); got != "  echo" {
+		t.Errorf("env should be cleared, got %q", got)
+	}
+}
+
+func TestLcmdParity(t *testing.T) {
+	local := LocalOnly()
+
+	local.Lcmd("exit 3")
+	if code := local.ExitCode(); code != 3 {
+		t.Errorf("expect exit code 3, got %d", code)
+	}
+	local.ClearError()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	local.LcmdContext(ctx, "sleep 10")
+	if err := local.Error(); err != context.DeadlineExceeded || time.Since(begin) > 5*time.Second {
+		t.Errorf("command should be killed by context: %v", err)
+	}
+	if code := local.ExitCode(); code != -1 {
+		t.Errorf("expect exit code -1, got %d", code)
+	}
+	local.ClearError()
+
+	local.SetLocalEnv(map[string]string{"SOCKER_A": "a b", "SOCKER_B": "b"})
+	local.Lcmd(`echo "$SOCKER_A,$SOCKER_B"`, "SOCKER_B=c")
+	if got := strings.TrimSpace(string(local.Output())); got != "a b,c" {
+		t.Errorf("unexpected env: %s", got)
+	}
+	if err := local.Error(); err != nil || local.ExitCode() != 0 {
+		t.Fatal(err)
+	}
+}
+
+func TestPutEmptyDir(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	os.MkdirAll(filepath.Join(src, "empty"), 0700)
+	os.MkdirAll(filepath.Join(src, "sub", "empty"), 0750)
+
+	local := LocalOnly()
+	local.Put(src, dst)
+	if err := local.Error(); err != nil {
+		t.Fatal(err)
+	}
+	for name, mode := range map[string]os.FileMode{"empty": 0700, "sub/empty": 0750} {
+		stat, err := os.Stat(filepath.Join(dst, filepath.FromSlash(name)))
+		if err != nil || !stat.IsDir() || stat.Mode().Perm() != mode {
+			t.Errorf("empty directory %s is not synced: %v", name, err)
+		}
+	}
+}
+
+func TestPutSparse(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 5*sparseBlockSize+100)
+	copy(data[sparseBlockSize:], "socker")
+	copy(data[3*sparseBlockSize+10:], "sparse")
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	ioutil.WriteFile(src, data, 0644)
+	ioutil.WriteFile(src+"2", data[:2*sparseBlockSize], 0644)
+
+	local := LocalOnly()
+	local.PutSparse(src, dst)
+	local.PutSparse(src+"2", dst+"2")
+	if err := local.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(dst); !bytes.Equal(got, data) {
+		t.Errorf("sparse copy mismatch, size %d", len(got))
+	}
+	if got, _ := ioutil.ReadFile(dst + "2"); !bytes.Equal(got, data[:2*sparseBlockSize]) {
+		t.Errorf("sparse copy mismatch, size %d", len(got))
+	}
+}
+
+func TestCommandWrapper(t *testing.T) {
+	local := LocalOnly()
+	local.Rcd("/tmp")
+	local.SetCommandWrapper(func(cmd string) string {
+		return "docker exec app sh -c " + shellQuote(cmd)
+	})
+
+	expect := "cd /tmp " + CmdSeperator + "  docker exec app sh -c 'echo ok'"
+	if got := local.rcmdStr("echo ok", ""); got != expect {
+		t.Errorf("expect %q, got %q", expect, got)
+	}
+	local.SetCommandWrapper(nil)
+	if got := local.rcmdStr("echo ok", ""); got != "cd /tmp "+CmdSeperator+"  echo ok" {
+		t.Errorf("wrapper should be removed, got %q", got)
+	}
+}
+
+func TestRopen(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	local := LocalOnly()
+	local.Rcd(dir)
+	local.RwriteFile("file", []byte("header:0000 body"))
+
+	fd, err := local.Ropen("file", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fd.Seek(7, io.SeekStart); err == nil {
+		_, err = fd.Write([]byte("1234"))
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := local.RreadFile("file"); string(data) != "header:1234 body" {
+		t.Errorf("patch file failed: %s, %v", data, local.Error())
+	}
+	if _, err = local.Ropen(".", os.O_RDONLY, 0); err != ErrIsDir {
+		t.Errorf("expect directory error, got %v", err)
+	}
+}
+
+func TestLcmdStdin(t *testing.T) {
+	local := LocalOnly()
+	local.LocalPipeInput(strings.NewReader("persistent"))
+
+	local.LcmdStdin("cat", []byte("socker"))
+	if got := string(local.Output()); got != "socker" {
+		t.Errorf("expect stdin from data, got %q", got)
+	}
+	local.Lcmd("cat")
+	if got := string(local.Output()); got != "persistent" {
+		t.Errorf("configured stdin should be kept, got %q", got)
+	}
+	if err := local.Error(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTunnelClosed(t *testing.T) {
+	local := LocalOnly()
+	if _, err := local.TunnelTo("127.0.0.1:5432"); err != ErrConnClosed {
+		t.Errorf("expect connection closed error, got %v", err)
+	}
+	if _, err := local.TunnelPair("127.0.0.1:5432"); err != ErrConnClosed {
+		t.Errorf("expect connection closed error, got %v", err)
+	}
+}
+
+func TestRreaddirFilter(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	local := LocalOnly()
+	local.Rcd(dir)
+	for _, name := range []string{"b.conf", "a.conf", "c.txt"} {
+		local.RwriteFile(name, nil)
+	}
+	os.Mkdir(filepath.Join(dir, "d.conf"), 0755)
+
+	items := local.RreaddirFilter(".", func(info os.FileInfo) bool {
+		return !info.IsDir() && filepath.Ext(info.Name()) == ".conf"
+	})
+	if err := local.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Name() != "a.conf" || items[1].Name() != "b.conf" {
+		t.Errorf("unexpected entries: %v", items)
+	}
+}
+
+func TestGetResumable(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	manifest := filepath.Join(dir, "manifest")
+	os.MkdirAll(filepath.Join(src, "sub", "empty"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "a"), []byte("aaa"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "sub", "b"), []byte("bbb"), 0644)
+
+	local := LocalOnly()
+	local.GetResumable(src, dst, manifest)
+	if err := local.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dst, "sub", "b")); string(data) != "bbb" {
+		t.Errorf("get failed: %s", data)
+	}
+	if stat, err := os.Stat(filepath.Join(dst, "sub", "empty")); err != nil || !stat.IsDir() {
+		t.Errorf("empty directory should be created: %v", err)
+	}
+
+	// downloaded files are skipped, changed ones are downloaded again
+	ioutil.WriteFile(filepath.Join(dst, "a"), []byte("xxx"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "sub", "b"), []byte("bbbb"), 0644)
+	local.GetResumable(src, dst, manifest)
+	if err := local.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dst, "a")); string(data) != "xxx" {
+		t.Errorf("downloaded file should be skipped: %s", data)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dst, "sub", "b")); string(data) != "bbbb" {
+		t.Errorf("changed file should be downloaded: %s", data)
+	}
+}
+
+// newTestSSHServer start a ssh server accepting any password, it runs no real
+// command: "fail" exits with 1, "json" prints a json object, "warnjson" also
+// prints a warning to stderr, "echo $!" prints a pid, others print "ok".
+// The count of executed commands is recorded in execs.
+func newTestSSHServer(t *testing.T, execs *int32) (addr string, closeFn func()) {
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	return serveTestSSH(t, config, execs)
+}
+
+// serveTestSSH start the test ssh server with config, a host key is added.
+func serveTestSSH(t *testing.T, config *ssh.ServerConfig, execs *int32) (addr string, closeFn func()) {
+	signer, err := ssh.ParsePrivateKey(testPrivateKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSSHConn(conn, config, execs)
+		}
+	}()
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+func serveTestSSHConn(conn net.Conn, config *ssh.ServerConfig, execs *int32) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go serveTestSSHForward(sconn, reqs)
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		ch, chReqs, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range chReqs {
+				if req.Type == "subsystem" {
+					serveTestSftp(ch, req)
+					continue
+				}
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				var payload struct{ Cmd string }
+				ssh.Unmarshal(req.Payload, &payload)
+				req.Reply(true, nil)
+				atomic.AddInt32(execs, 1)
+
+				status := uint32(0)
+				switch {
+				case strings.HasSuffix(payload.Cmd, "fail"):
+					ch.Stderr().Write([]byte("failed\n"))
+					status = 1
+				case strings.HasPrefix(payload.Cmd, "test -e ") && strings.Contains(payload.Cmd, "missing"):
+					status = 1
+				case strings.HasSuffix(payload.Cmd, "slow"):
+					time.Sleep(150 * time.Millisecond)
+					ch.Write([]byte("ok\n"))
+				case strings.HasSuffix(payload.Cmd, "printcmd"):
+					ch.Write([]byte(payload.Cmd + "\n"))
+				case strings.HasSuffix(payload.Cmd, "hang"):
+					// like OpenSSH, signals are ignored
+					ch.Write([]byte("ready\n"))
+					time.Sleep(2 * time.Second)
+				case strings.HasSuffix(payload.Cmd, "echo $!"):
+					ch.Write([]byte("4242\n"))
+				case strings.HasSuffix(payload.Cmd, "warnjson"):
+					ch.Stderr().Write([]byte("deprecated\n"))
+					ch.Write([]byte(`{"status":"warn"}`))
+				case strings.HasSuffix(payload.Cmd, "json"):
+					ch.Write([]byte(`{"status":"ok"}`))
+				default:
+					ch.Write([]byte("ok\n"))
+				}
+				ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+				ch.Close()
+			}
+		}()
+	}
+}
+
+// serveTestSftp serve the sftp subsystem on the channel with local fs
+func serveTestSftp(ch ssh.Channel, req *ssh.Request) {
+	var payload struct{ Name string }
+	ssh.Unmarshal(req.Payload, &payload)
+	if payload.Name != "sftp" {
+		req.Reply(false, nil)
+		return
+	}
+	req.Reply(true, nil)
+	go func() {
+		defer ch.Close()
+		server, err := sftp.NewServer(ch)
+		if err != nil {
+			return
+		}
+		server.Serve()
+	}()
+}
+
+// serveTestSSHForward handle "tcpip-forward" requests by listening on local
+// host, the port of existing listener is refused.
+func serveTestSSHForward(sconn *ssh.ServerConn, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		if req.Type != "tcpip-forward" {
+			req.Reply(false, nil)
+			continue
+		}
+		var payload struct {
+			Addr string
+			Port uint32
+		}
+		ssh.Unmarshal(req.Payload, &payload)
+		ln, err := net.Listen("tcp", net.JoinHostPort(payload.Addr, strconv.Itoa(int(payload.Port))))
+		if err != nil {
+			req.Reply(false, nil)
+			continue
+		}
+		port := uint32(ln.Addr().(*net.TCPAddr).Port)
+		req.Reply(true, ssh.Marshal(struct{ Port uint32 }{port}))
+
+		go func() {
+			defer ln.Close()
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				origin := conn.RemoteAddr().(*net.TCPAddr)
+				ch, chReqs, err := sconn.OpenChannel("forwarded-tcpip", ssh.Marshal(struct {
+					Addr       string
+					Port       uint32
+					OriginAddr string
+					OriginPort uint32
+				}{payload.Addr, port, origin.IP.String(), uint32(origin.Port)}))
+				if err != nil {
+					conn.Close()
+					return
+				}
+				go ssh.DiscardRequests(chReqs)
+				go func() {
+					io.Copy(ch, conn)
+					ch.CloseWrite()
+				}()
+				go func() {
+					io.Copy(conn, ch)
+					conn.Close()
+				}()
+			}
+		}()
+	}
+}
+
+func TestAutoReconnect(t *testing.T) {
+	var execs int32
+	addr, closeFn := newTestSSHServer(t, &execs)
+	defer closeFn()
+
+	s, err := Dial(addr, &Auth{User: "root", Password: "root", NoSFTP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetAutoReconnect(true)
+
+	// simulate a dropped connection
+	s.conn.client.Close()
+	s.Rcmd("echo")
+	if err = s.Error(); err != nil || string(s.Output()) != "ok\n" || execs != 1 {
+		t.Fatalf("command should be retried after reconnect: %v, %d", err, execs)
+	}
+
+	s.Rcmd("fail")
+	if _, ok := s.Error().(*ssh.ExitError); !ok || execs != 2 {
+		t.Errorf("command failure should not be retried: %v, %d", s.Error(), execs)
+	}
+	s.ClearError()
+
+	s.SetAutoReconnect(false)
+	s.conn.client.Close()
+	s.Rcmd("echo")
+	if s.Error() == nil || execs != 2 {
+		t.Errorf("command should not be retried if disabled: %d", execs)
+	}
+}
+
+func TestReconnectShared(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	var execs int32
+	addr, closeFn := newTestSSHServer(t, &execs)
+	defer closeFn()
+
+	s, err := Dial(addr, &Auth{User: "root", Password: "root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var written int32
+	s.SetRemoteFs(InstrumentedFs(s.rfs, FileHooks{
+		OnWrite: func(name string, n int, err error) {
+			atomic.AddInt32(&written, int32(n))
+		},
+	}))
+	clone := s.Derive()
+	defer clone.Close()
+
+	s.conn.client.Close()
+	if err = s.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	clone.Rcmd("echo")
+	if err = clone.Error(); err != nil || string(clone.Output()) != "ok\n" {
+		t.Errorf("clone should use the new connection: %q, %v", clone.Output(), err)
+	}
+	s.RwriteFile(filepath.Join(dir, "file"), []byte("socker"))
+	if err = s.Error(); err != nil || atomic.LoadInt32(&written) != 6 {
+		t.Errorf("remote fs wrappers should be kept: %d, %v", written, err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "file")); err != nil || string(data) != "socker" {
+		t.Errorf("write through new sftp client failed: %q, %v", data, err)
+	}
+
+	// the connection is not locked while fn is running
+	done := make(chan error, 1)
+	go func() {
+		done <- s.WithSession(func(*ssh.Session) error {
+			return s.Reconnect()
+		})
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reconnect in WithSession deadlocked")
+	}
+	if err = clone.Ping(); err != nil {
+		t.Errorf("clone should be alive after reconnect: %v", err)
+	}
+}
+
+func TestRcmdCombined(t *testing.T) {
+	var execs int32
+	addr, closeFn := newTestSSHServer(t, &execs)
+	defer closeFn()
+
+	s, err := Dial(addr, &Auth{User: "root", Password: "root", NoSFTP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var stdout bytes.Buffer
+	s.RemotePipeOutput(&stdout, nil)
+	out, err := s.RcmdCombined("echo")
+	if err != nil || string(out) != "ok\n" || stdout.Len() != 0 {
+		t.Errorf("unexpected output: %q, %v", out, err)
+	}
+	if _, err = s.RcmdCombined("fail"); err == nil || s.Error() != nil || s.Output() != nil {
+		t.Errorf("instance state should not be changed: %v", err)
+	}
+
+	out, err = LocalOnly().LcmdCombined("echo out && echo err >&2")
+	if err != nil || string(out) != "out\nerr\n" {
+		t.Errorf("unexpected output: %q, %v", out, err)
+	}
+}
+
+func TestForwardRemote(t *testing.T) {
+	var execs int32
+	addr, closeFn := newTestSSHServer(t, &execs)
+	defer closeFn()
+
+	s, err := Dial(addr, &Auth{User: "root", Password: "root", NoSFTP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// local echo service
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	// the preferred port is occupied, a server assigned one is used
+	occupied := echo.Addr().String()
+	forward, err := s.ForwardRemote(occupied, echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forward.Close()
+	bound := forward.Addr().(*net.TCPAddr)
+	if bound.Port == 0 || bound.String() == occupied {
+		t.Fatalf("unexpected bound addr: %s", bound)
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(bound.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("socker"))
+	buf := make([]byte, 6)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "socker" {
+		t.Errorf("forward failed: %s, %v", buf, err)
+	}
+}
+
+func TestOutputOnFailure(t *testing.T) {
+	local := LocalOnly()
+	local.Lcmd("echo start && echo oops >&2 && exit 2")
+	if out := string(local.Output()); out != "start\noops\n" || local.ExitCode() != 2 {
+		t.Errorf("output should be kept: %q, %v", out, local.Error())
+	}
+	local.ClearError()
+
+	var stdout bytes.Buffer
+	local.LocalPipeOutput(&stdout, nil)
+	local.Lcmd("echo start && echo oops >&2 && exit 2")
+	// stdout and stderr are copied separately, the order is not determined
+	if out := string(local.Output()); len(out) != 11 || !strings.Contains(out, "oops\n") || stdout.String() != "start\n" {
+		t.Errorf("tail of piped output should be kept: %q, %q", out, stdout.String())
+	}
+	local.ClearError()
+
+	local.Lcmd("echo ok")
+	if local.Output() != nil || stdout.String() != "start\nok\n" {
+		t.Errorf("output of succeeded command should be piped only: %q", local.Output())
+	}
+
+	tail := lockedBuffer{limit: 4}
+	for i := 0; i < 10; i++ {
+		tail.Write([]byte(strconv.Itoa(i)))
+	}
+	if got := string(tail.Bytes()); got != "6789" {
+		t.Errorf("unexpected tail: %s", got)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	os.MkdirAll(filepath.Join(src, "a", "b", "c"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "a", "b", "c", "file"), nil, 0644)
+
+	local := LocalOnly()
+	local.SetMaxDepth(3)
+	local.Put(src, filepath.Join(dir, "dst"))
+	if err := local.Error(); !errors.Is(err, ErrMaxDepthExceeded) {
+		t.Errorf("expect max depth error, got %v", err)
+	}
+	local.ClearError()
+
+	local.Lremove(src, true)
+	if err := local.Error(); !errors.Is(err, ErrMaxDepthExceeded) {
+		t.Errorf("expect max depth error, got %v", err)
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("nothing should be removed: %v", err)
+	}
+	local.ClearError()
+
+	if err := WalkDepth(FsLocal{}, src, 4, func(string, os.FileInfo, error) error { return nil }); err != nil {
+		t.Errorf("walk should succeed: %v", err)
+	}
+
+	local.SetMaxDepth(0)
+	local.Put(src, filepath.Join(dir, "dst"))
+	local.Lremove(src, true)
+	if err := local.Error(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRcmdPipe(t *testing.T) {
+	var execs int32
+	addr, closeFn := newTestSSHServer(t, &execs)
+	defer closeFn()
+
+	s, err := Dial(addr, &Auth{User: "root", Password: "root", NoSFTP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var out bytes.Buffer
+	code, err := s.RcmdPipe("echo", &out, &out)
+	if code != 0 || err != nil || out.String() != "ok\n" {
+		t.Errorf("unexpected result: %d, %v, %q", code, err, out.String())
+	}
+	code, err = s.RcmdPipe("fail", &out, nil)
+	if code != 1 || err == nil || s.Error() != nil {
+		t.Errorf("unexpected result: %d, %v", code, err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code, err = LocalOnly().LcmdPipe("echo out && echo err >&2 && exit 3", &stdout, &stderr)
+	if code != 3 || err == nil || stdout.String() != "out\n" || stderr.String() != "err\n" {
+		t.Errorf("unexpected result: %d, %v, %q, %q", code, err, stdout.String(), stderr.String())
+	}
+}
+
+func TestDefaultDirMode(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	ioutil.WriteFile(src, []byte("secret"), 0600)
+
+	local := LocalOnly()
+	local.SetDefaultDirMode(0750)
+	local.Put(src, filepath.Join(dir, "a", "b", "secret"))
+	if err := local.Error(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", filepath.Join("a", "b")} {
+		stat, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Mode().Perm() != 0750 {
+			t.Errorf("unexpected mode of %s: %v", name, stat.Mode())
+		}
+	}
+}
+
+func TestViaGate(t *testing.T) {
+	gate := LocalOnly()
+	direct := LocalOnly()
+	if direct.ViaGate() || direct.Gate() != nil {
+		t.Error("connection should be direct")
+	}
+
+	agent := LocalOnly()
+	agent.gate = gate
+	if !agent.ViaGate() || agent.Gate() != gate {
+		t.Error("connection should be dialed through gate")
+	}
+}
+
+func TestAuthTestConnect(t *testing.T) {
+	var execs int32
+	addr, closeFn := newTestSSHServer(t, &execs)
+
+	auth := &Auth{User: "root", Password: "root", NoSFTP: true}
+	if err := auth.TestConnect(addr); err != nil || execs != 1 {
+		t.Errorf("test connect failed: %v, %d", err, execs)
+	}
+	closeFn()
+	if err := auth.TestConnect(addr); err == nil {
+		t.Error("connecting to closed server should fail")
+	}
+}
+
+func TestRcmdJSON(t *testing.T) {
+	var execs int32
+	addr, closeFn := newTestSSHServer(t, &execs)
+	defer closeFn()
+
+	s, err := Dial(addr, &Auth{User: "root", Password: "root", NoSFTP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var v struct{ Status string }
+	if err = s.RcmdJSON("json", &v); err != nil || v.Status != "ok" {
+		t.Errorf("unmarshal failed: %+v, %v", v, err)
+	}
+	if err = s.RcmdJSON("echo", &v); err == nil || !strings.HasPrefix(err.Error(), "invalid json output") {
+		t.Errorf("expect invalid json error, got %v", err)
+	}
+	err = s.RcmdJSON("fail", &v)
+	if _, ok := errors.Unwrap(err).(*ssh.ExitError); !ok || !strings.HasSuffix(err.Error(), ": failed") {
+		t.Errorf("expect exit error with stderr, got %v", err)
+	}
+
+	if err = LocalOnly().LcmdJSON(`echo '{"Status":"local"}'`, &v); err != nil || v.Status != "local" {
+		t.Errorf("unmarshal failed: %+v, %v", v, err)
+	}
+
+	warnings, err := s.RcmdJSONWarnings("warnjson", &v)
+	if err != nil || v.Status != "warn" || warnings != "deprecated" {
+		t.Errorf("unexpected result: %+v, %q, %v", v, warnings, err)
+	}
+	warnings, err = LocalOnly().LcmdJSONWarnings(`echo warning >&2; echo '{"Status":"ok"}'`, &v)
+	if err != nil || v.Status != "ok" || warnings != "warning" {
+		t.Errorf("unexpected result: %+v, %q, %v", v, warnings, err)
+	}
+}
+
+func TestTailLines(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	for i := 0; i < 2000; i++ {
+		buf.WriteString("line " + strconv.Itoa(i) + "\n")
+	}
+	local := LocalOnly()
+	local.Lcd(dir)
+	local.Rcd(dir)
+	local.LwriteFile("long", buf.Bytes())
+	local.LwriteFile("short", []byte("a\r\nb\nc"))
+	local.LwriteFile("empty", nil)
+
+	if lines, err := local.RtailLines("long", 3); err != nil || strings.Join(lines, ",") != "line 1997,line 1998,line 1999" {
+		t.Errorf("unexpected tail: %q, %v", lines, err)
+	}
+	if lines, err := local.LtailLines("long", 1000); err != nil || len(lines) != 1000 || lines[0] != "line 1000" {
+		t.Errorf("unexpected tail: %d lines, %v", len(lines), err)
+	}
+	if lines, err := local.RtailLines("short", 5); err != nil || strings.Join(lines, ",") != "a,b,c" {
+		t.Errorf("unexpected tail: %q, %v", lines, err)
+	}
+	if lines, err := local.RtailLines("empty", 5); err != nil || len(lines) != 0 {
+		t.Errorf("unexpected tail: %q, %v", lines, err)
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	local := LocalOnly()
+	local.Lcd(dir)
+	local.Rcd(dir)
+	local.RwriteFile("remote", []byte("0123456789"))
+
+	cases := []struct {
+		Offset, Length int64
+		Expect         string
+	}{
+		{Offset: 2, Length: 3, Expect: "234"},
+		{Offset: 7, Length: -1, Expect: "789"},
+		{Offset: 10, Length: -1, Expect: ""},
+		{Offset: 0, Length: 10, Expect: "0123456789"},
+	}
+	for i, c := range cases {
+		local.GetRange("remote", "range/local", c.Offset, c.Length)
+		if data := local.LreadFile("range/local"); local.Error() != nil || string(data) != c.Expect {
+			t.Errorf("case %d: expect %q, got %q, %v", i, c.Expect, data, local.Error())
+		}
+	}
+
+	for _, r := range [][2]int64{{-1, 1}, {11, -1}, {5, 6}, {0, -2}} {
+		local.GetRange("remote", "range/local", r[0], r[1])
+		if !errors.Is(local.Error(), ErrInvalidRange) {
+			t.Errorf("range %v should be rejected, got %v", r, local.Error())
+		}
+		local.ClearError()
+	}
+}
+
+func TestRcmdExpect(t *testing.T) {
+	var execs int32
+	addr, closeFn := newTestSSHServer(t, &execs)
+	defer closeFn()
+
+	s, err := Dial(addr, &Auth{User: "root", Password: "root", NoSFTP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.SetRemoteEnv(map[string]string{"A": "1"})
+	s.WithEnv(map[string]string{"B": "2"}, func(s *SSH) {
+		line, err := s.RcmdExpect("printcmd", regexp.MustCompile("printcmd"), time.Second)
+		if err != nil || !strings.Contains(string(line), "export A='1' B='2'") {
+			t.Errorf("env should be applied: %q, %v", line, err)
+		}
+	})
+
+	start := time.Now()
+	line, err := s.RcmdExpect("hang", regexp.MustCompile("^ready$"), time.Second)
+	if err != nil || string(line) != "ready" {
+		t.Errorf("unexpected result: %q, %v", line, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("session should be closed once matched, took %s", elapsed)
+	}
+	if _, err = s.RcmdExpect("hang", regexp.MustCompile("never"), 50*time.Millisecond); err != ErrExpectTimeout {
+		t.Errorf("expect timeout error, got %v", err)
+	}
+	if _, err = s.RcmdExpect("echo", regexp.MustCompile("never"), time.Second); err != ErrExpectNotMatched {
+		t.Errorf("expect not matched error, got %v", err)
+	}
+	if _, err = s.RcmdExpect("fail", regexp.MustCompile("ok"), time.Second); !errors.As(err, new(*ssh.ExitError)) {
+		t.Errorf("expect exit error, got %v", err)
+	}
+}
+
+func TestCmdExpectExit(t *testing.T) {
+	var execs int32
+	addr, closeFn := newTestSSHServer(t, &execs)
+	defer closeFn()
+
+	s, err := Dial(addr, &Auth{User: "root", Password: "root", NoSFTP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err = s.RcmdExpectExit("fail", 1); err != nil {
+		t.Errorf("exit code 1 should be expected: %v", err)
+	}
+	err = s.RcmdExpectExit("fail", 0)
+	if !errors.Is(err, ErrUnexpectedExitCode) || !strings.HasSuffix(err.Error(), "got 1, want 0, output: failed") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	local := LocalOnly()
+	if err = local.LcmdExpectExit("echo abc | grep -q xyz", 1); err != nil {
+		t.Errorf("no match should be expected: %v", err)
+	}
+	if err = local.LcmdExpectExit("echo abc", 1); !errors.Is(err, ErrUnexpectedExitCode) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if local.Error() != nil {
+		t.Error("state of instance should not be changed")
+	}
+}
+
+func TestDerive(t *testing.T) {
+	local := LocalOnly()
+	local.SetRemoteEnv(map[string]string{"A": "1"})
+	var out bytes.Buffer
+	local.LocalPipeOutput(&out, &out)
+	_, refs := local.Status()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			worker := local.Derive()
+			defer worker.Close()
+			worker.Lcd("/")
+			worker.SetRemoteEnv(map[string]string{"A": strconv.Itoa(i)})
+			worker.Lcmd("echo " + strconv.Itoa(i))
+			if got := string(worker.Output()); worker.Error() != nil || got != strconv.Itoa(i)+"\n" {
+				t.Errorf("worker %d: unexpected output %q, %v", i, got, worker.Error())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if _, r := local.Status(); r != refs {
+		t.Errorf("reference count should be restored: %d, %d", refs, r)
+	}
+	if local.Lcwd() == "/" || local.RemoteEnv()["A"] != "1" || out.Len() != 0 {
+		t.Errorf("parent state should be unchanged: %s, %v, %q", local.Lcwd(), local.RemoteEnv(), out.String())
+	}
+}
+
+func TestCloseKillBackground(t *testing.T) {
+	var execs int32
+	addr, closeFn := newTestSSHServer(t, &execs)
+	defer closeFn()
+
+	auth := &Auth{User: "root", Password: "root", NoSFTP: true}
+	s, err := Dial(addr, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := s.RcmdBgResult("sleep 100", "", "")
+	if err != nil || job.Pid != 4242 {
+		t.Fatalf("unexpected job: %+v, %v", job, err)
+	}
+	s.Close()
+	if n := atomic.LoadInt32(&execs); n != 1 {
+		t.Errorf("Close should leave background jobs running, got %d commands", n)
+	}
+
+	s, err = Dial(addr, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone := s.NopClose()
+	clone.RcmdBgResult("sleep 100", "", "")
+	clone.Close()
+	if err = s.CloseKillBackground(); err != nil {
+		t.Error(err)
+	}
+	if n := atomic.LoadInt32(&execs); n != 3 {
+		t.Errorf("jobs of clones should be killed, got %d commands", n)
+	}
+}
+
+func TestRexistsNoSFTP(t *testing.T) {
+	var execs int32
+	addr, closeFn := newTestSSHServer(t, &execs)
+	defer closeFn()
+
+	s, err := Dial(addr, &Auth{User: "root", Password: "root", NoSFTP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if !s.Rexists("/etc/hosts") {
+		t.Errorf("path should exist: %v", s.Error())
+	}
+	if s.Rexists("/etc/missing") || s.Error() != nil {
+		t.Errorf("path should not exist: %v", s.Error())
+	}
+	if n := atomic.LoadInt32(&execs); n != 2 {
+		t.Errorf("expect 2 commands, got %d", n)
+	}
+
+	if err := s.RwaitFile("/etc/hosts", time.Second, 10*time.Millisecond); err != nil {
+		t.Errorf("waiting existing file should succeed: %v", err)
+	}
+	if err := s.RwaitFile("/etc/missing", 50*time.Millisecond, 10*time.Millisecond); err != ErrWaitTimeout {
+		t.Errorf("expect wait timeout, got %v", err)
+	}
+}
+
+func TestIdleTimeoutRcmdPipe(t *testing.T) {
+	var execs int32
+	addr, closeFn := newTestSSHServer(t, &execs)
+	defer closeFn()
+
+	s, err := Dial(addr, &Auth{User: "root", Password: "root", NoSFTP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetIdleTimeout(50 * time.Millisecond)
+
+	var out bytes.Buffer
+	if code, err := s.RcmdPipe("slow", &out, &out); code != 0 || err != nil || out.String() != "ok\n" {
+		t.Fatalf("running command should not be interrupted: %d, %q, %v", code, out.String(), err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := s.RcmdPipe("echo", &out, &out); err != ErrConnClosed {
+		t.Errorf("expect connection closed, got %v", err)
+	}
+}
+
+func TestRemoteTempDir(t *testing.T) {
+	fs := NewFsMem()
+	s := LocalOnly()
+	s.SetRemoteFs(fs)
+
+	if dir, err := s.RemoteTempDir(""); err != nil || dir != DefaultRemoteTempDir {
+		t.Errorf("expect default temp dir, got %s, %v", dir, err)
+	}
+	if dir, err := s.RemoteTempDir("/srv/app/config.yml"); err != nil || dir != "/srv/app" {
+		t.Errorf("expect directory of target, got %s, %v", dir, err)
+	}
+
+	s.SetRemoteTempDir("/scratch")
+	if _, err := s.RemoteTempDir(""); err != ErrTempDirNotWritable {
+		t.Errorf("expect not writable error, got %v", err)
+	}
+	fs.MkdirAll("/scratch", 0755)
+	if dir, err := s.RemoteTempDir("/srv/app/config.yml"); err != nil || dir != "/scratch" {
+		t.Errorf("expect configured temp dir, got %s, %v", dir, err)
+	}
+	if err := fs.Remove("/scratch"); err != nil {
+		t.Errorf("probe file should be removed: %v", err)
+	}
+
+	// the check is shared by clones, removing the directory isn't noticed
+	clone := s.Derive()
+	defer clone.Close()
+	var wg sync.WaitGroup
+	for _, s := range []*SSH{s, clone} {
+		wg.Add(1)
+		go func(s *SSH) {
+			defer wg.Done()
+			if dir, err := s.RemoteTempDir(""); err != nil || dir != "/scratch" {
+				t.Errorf("expect cached temp dir, got %s, %v", dir, err)
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+func TestApplyMetadata(t *testing.T) {
+	fs := NewFsMem()
+	fs.MkdirAll("/site/assets", 0755)
+	for _, name := range []string{"/site/index.html", "/site/assets/app.js"} {
+		fd, _ := fs.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0644)
+		fd.Close()
+	}
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	s := LocalOnly()
+	s.SetRemoteFs(fs)
+	s.RapplyMetadata("/site", map[string]FileMeta{
+		".":             {Mode: 0700},
+		"assets":        {Mode: 0500, Mtime: mtime},
+		"assets/app.js": {Mode: 0600, Chown: true, Uid: 1000, Gid: 1000},
+		"index.html":    {Mtime: mtime},
+		"missing":       {Mode: 0644},
+	})
+	errs, ok := s.Error().(SyncErrors)
+	if !ok || len(errs) != 1 || errs[0].Path != "missing" || errs[0].Err != os.ErrNotExist {
+		t.Fatalf("expect only the missing entry failed, got %v", s.Error())
+	}
+
+	for name, mode := range map[string]os.FileMode{
+		"/site":               os.ModeDir | 0700,
+		"/site/assets":        os.ModeDir | 0500,
+		"/site/assets/app.js": 0600,
+		"/site/index.html":    0644,
+	} {
+		info, err := fs.Stat(name)
+		if err != nil || info.Mode() != mode {
+			t.Errorf("%s: expect mode %s, got %v, %v", name, mode, info, err)
+		}
+	}
+	for _, name := range []string{"/site/assets", "/site/index.html"} {
+		if info, err := fs.Stat(name); err != nil || !info.ModTime().Equal(mtime) {
+			t.Errorf("%s: modify time not applied: %v", name, err)
+		}
+	}
+}
+
+// lockedFs refuse to remove the locked path
+type lockedFs struct {
+	*FsMem
+	locked string
+}
+
+func (f lockedFs) Remove(name string) error {
+	if name == f.locked {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	return f.FsMem.Remove(name)
+}
+
+func TestRemoveAllProgress(t *testing.T) {
+	fs := NewFsMem()
+	for _, name := range []string{"/data/logs/a.log", "/data/logs/b.log", "/data/cache/c.bin"} {
+		fs.MkdirAll(path.Dir(name), 0755)
+		fd, _ := fs.Create(name)
+		fd.Close()
+	}
+	s := LocalOnly()
+	s.SetRemoteFs(lockedFs{FsMem: fs, locked: "/data/logs/a.log"})
+
+	var removed, failed []string
+	err := s.RremoveAllProgress("/data", func(path string) {
+		removed = append(removed, path)
+	}, func(path string, err error) {
+		failed = append(failed, path)
+	})
+	errs, ok := err.(SyncErrors)
+	if !ok || len(errs) != 1 || errs[0].Path != "/data/logs/a.log" || strings.Join(failed, ",") != "/data/logs/a.log" {
+		t.Fatalf("expect only the locked file failed, got %v, %v", failed, err)
+	}
+	expect := "/data/logs/b.log,/data/cache/c.bin,/data/cache"
+	if got := strings.Join(removed, ","); got != expect {
+		t.Errorf("expect removed %s, got %s", expect, got)
+	}
+	if _, err = fs.Stat("/data/logs/a.log"); err != nil {
+		t.Errorf("locked file should be kept: %v", err)
+	}
+
+	if err = s.RremoveAllProgress("/missing", nil, nil); err != nil {
+		t.Errorf("removing missing path should succeed: %v", err)
+	}
+}
+
+func TestRcmdToFile(t *testing.T) {
+	var execs int32
+	addr, closeFn := newTestSSHServer(t, &execs)
+	defer closeFn()
+
+	s, err := Dial(addr, &Auth{User: "root", Password: "root", NoSFTP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	var pipe bytes.Buffer
+	s.RemotePipeOutput(&pipe, &pipe)
+	path := filepath.Join(dir, "out")
+	s.RcmdToFile("echo", path)
+	if data, err := ioutil.ReadFile(path); s.Error() != nil || err != nil || string(data) != "ok\n" {
+		t.Errorf("unexpected file content: %q, %v, %v", data, err, s.Error())
+	}
+	if pipe.Len() != 0 {
+		t.Errorf("configured pipe should not be used: %q", pipe.String())
+	}
+}
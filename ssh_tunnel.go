@@ -0,0 +1,111 @@
+package socker
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// TunnelTo open a tcp connection to remoteAddr through the ssh connection, such
+// as an internal database only reachable from remote host. It's the same as
+// DialConn("tcp", remoteAddr), the caller should close the connection.
+func (s *SSH) TunnelTo(remoteAddr string) (net.Conn, error) {
+	return s.dialBusy("tcp", remoteAddr)
+}
+
+// TunnelPair do the same thing as TunnelTo but return the local end of a
+// net.Pipe forwarded to the tunnel, it supports deadlines which tunnel
+// connections don't. Closing it closes the tunnel, and it's read EOF once the
+// tunnel is closed by remote.
+func (s *SSH) TunnelPair(remoteAddr string) (net.Conn, error) {
+	remote, err := s.TunnelTo(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	local, inner := net.Pipe()
+	go func() {
+		io.Copy(remote, inner)
+		remote.Close()
+	}()
+	go func() {
+		io.Copy(inner, remote)
+		inner.Close()
+	}()
+	return local, nil
+}
+
+// RemoteForward is a listener on remote host forwarding connections to local
+// address.
+type RemoteForward struct {
+	ln        net.Listener
+	localAddr string
+	// end the busy state of idle timer
+	end  func()
+	once sync.Once
+}
+
+// ForwardRemote listen on remoteAddr of remote host and forward accepted
+// connections to localAddr. Port 0 let the server assign a port, and if the
+// preferred port can't be bound, a server assigned one is used instead. Addr of
+// the returned RemoteForward is the actual bound address.
+func (s *SSH) ForwardRemote(remoteAddr, localAddr string) (*RemoteForward, error) {
+	if s.conn.client == nil {
+		return nil, ErrConnClosed
+	}
+	end, err := s.busy()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := s.conn.client.Listen("tcp", remoteAddr)
+	if err != nil {
+		host, port, perr := net.SplitHostPort(remoteAddr)
+		if perr != nil || port == "0" {
+			end()
+			return nil, err
+		}
+		ln, err = s.conn.client.Listen("tcp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			end()
+			return nil, err
+		}
+	}
+	f := &RemoteForward{ln: ln, localAddr: localAddr, end: end}
+	go f.serve()
+	return f, nil
+}
+
+// Addr return the bound address on remote host
+func (f *RemoteForward) Addr() net.Addr {
+	return f.ln.Addr()
+}
+
+// Close stop listening, established connections are not affected.
+func (f *RemoteForward) Close() error {
+	err := f.ln.Close()
+	f.once.Do(f.end)
+	return err
+}
+
+func (f *RemoteForward) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.forward(conn)
+	}
+}
+
+func (f *RemoteForward) forward(conn net.Conn) {
+	local, err := net.Dial("tcp", f.localAddr)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go func() {
+		io.Copy(local, conn)
+		local.Close()
+	}()
+	io.Copy(conn, local)
+	conn.Close()
+}